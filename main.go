@@ -2,65 +2,528 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
 	"net/mail"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	_ "modernc.org/sqlite"
 )
 
 // entity
+type Status int
+
+const (
+	StatusActive Status = iota + 1
+	StatusInactive
+	StatusSuspended
+)
+
+func (s Status) Valid() bool {
+	switch s {
+	case StatusActive, StatusInactive, StatusSuspended:
+		return true
+	}
+	return false
+}
+
+// Email is a validated address normalized to trimmed lower case, so the same
+// mailbox written differently compares equal.
+type Email struct {
+	address string
+}
+
+// maxEmailLength is the longest address allowed in an SMTP path (RFC 5321).
+const maxEmailLength = 254
+
+func NewEmail(raw string) (Email, error) {
+	trimmed := strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(trimmed)
+	if err != nil {
+		return Email{}, err
+	}
+	if addr.Name != "" || addr.Address != trimmed {
+		return Email{}, errors.New("email must be a bare address without a display name")
+	}
+	if len(addr.Address) > maxEmailLength {
+		return Email{}, fmt.Errorf("email must not be longer than %d characters", maxEmailLength)
+	}
+	if strings.Count(addr.Address, "@") != 1 {
+		return Email{}, errors.New("email must contain exactly one @")
+	}
+	return Email{address: strings.ToLower(addr.Address)}, nil
+}
+
+func (e Email) String() string { return e.address }
+
+// Masked hides the local part except for its first character, e.g.
+// j***@example.com.
+func (e Email) Masked() string {
+	local, domain, ok := strings.Cut(e.address, "@")
+	if !ok || local == "" {
+		return e.address
+	}
+	_, size := utf8.DecodeRuneInString(local)
+	return local[:size] + "***@" + domain
+}
+
 type User struct {
 	id         int
 	name       string
-	email      string
-	statusCode int
+	email      Email
+	statusCode Status
 }
 
-func NewUser(id int, name string, email string, statusCode int) (*User, error) {
-	if id < 1 {
-		return nil, errors.New("id must be greater than 1")
-	}
-	if name == "" {
-		return nil, errors.New("name must not empty")
+func NewUser(id int, name string, email string, statusCode Status) (*User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
 	}
-	if _, err := mail.ParseAddress(email); err != nil {
+	return newUser(id, name, email, statusCode)
+}
+
+// NewUserUnchecked builds a user WITHOUT validating or normalizing anything,
+// bypassing every invariant NewUser enforces. Use it only for data this
+// program wrote itself, such as a re-import of its own export; anything from
+// outside must go through NewUser.
+func NewUserUnchecked(id int, name string, email string, statusCode Status) *User {
+	return &User{id: id, name: name, email: Email{address: email}, statusCode: statusCode}
+}
+
+// NewUnsavedUser builds a user that has not been assigned an id by the store yet.
+func NewUnsavedUser(name string, email string, statusCode Status) (*User, error) {
+	return newUser(0, name, email, statusCode)
+}
+
+func newUser(id int, name string, email string, statusCode Status) (*User, error) {
+	cleanName, normalized, err := validateUserFields(name, email, statusCode)
+	if err != nil {
 		return nil, err
 	}
 	return &User{
 		id:         id,
-		name:       name,
-		email:      email,
+		name:       cleanName,
+		email:      normalized,
 		statusCode: statusCode,
 	}, nil
 }
 
-func (u User) ID() int         { return u.id }
-func (u User) Name() string    { return u.name }
-func (u User) Email() string   { return u.email }
-func (u User) StatusCode() int { return u.statusCode }
+func validateUserID(id int) error {
+	if id < 1 {
+		return errors.New("id must be greater than 1")
+	}
+	return nil
+}
+
+// normalizeName trims the name, turns control characters into spaces and
+// collapses runs of whitespace, so "  Foo   Bar  " becomes "Foo Bar".
+func normalizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, name)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// validateUserFields checks everything but the id and returns the normalized
+// name and email.
+func validateUserFields(name string, email string, statusCode Status) (string, Email, error) {
+	name = normalizeName(name)
+	if name == "" {
+		return "", Email{}, errors.New("name must not empty")
+	}
+	normalized, err := NewEmail(email)
+	if err != nil {
+		return "", Email{}, err
+	}
+	if !statusCode.Valid() {
+		return "", Email{}, fmt.Errorf("status code %d is not valid", statusCode)
+	}
+	return name, normalized, nil
+}
+
+func (u User) ID() int            { return u.id }
+func (u User) Name() string       { return u.name }
+func (u User) Email() string      { return u.email.String() }
+func (u User) StatusCode() Status { return u.statusCode }
+
+// String renders the user for logs with the email masked.
+func (u User) String() string {
+	return fmt.Sprintf("User(id=%d, name=%s, email=%s)", u.id, u.name, u.email.Masked())
+}
+
+// Suspend moves the user to StatusSuspended. Suspending an already suspended
+// user is an illegal transition.
+func (u *User) Suspend() error {
+	if u.statusCode == StatusSuspended {
+		return fmt.Errorf("user id %d: %w", u.id, ErrIllegalStatusTransition)
+	}
+	u.statusCode = StatusSuspended
+	return nil
+}
+
+// Equal reports whether both users hold the same values. Two nil users are equal.
+func (u *User) Equal(other *User) bool {
+	if u == nil || other == nil {
+		return u == other
+	}
+	return *u == *other
+}
+
+// MarshalJSON writes the S3User shape, which every JSON upload backend stores.
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toS3User(&u))
+}
+
+// UnmarshalJSON decodes a user through NewUser, so invalid input is rejected
+// the same way as anywhere else.
+func (u *User) UnmarshalJSON(data []byte) error {
+	var j S3User
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	decoded, err := NewUser(j.Id, j.Name, j.Email, Status(j.StatusCode))
+	if err != nil {
+		return err
+	}
+	*u = *decoded
+	return nil
+}
+
+// entity: errors
+var (
+	ErrUserNotFound            = errors.New("user not found")
+	ErrDuplicateEmail          = errors.New("email already exists")
+	ErrDuplicateUserID         = errors.New("user id already exists")
+	ErrIllegalStatusTransition = errors.New("illegal status transition")
+)
+
+// entity: clock
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// entity: ordering
+type UserSortField string
+
+const (
+	SortByID    UserSortField = "id"
+	SortByName  UserSortField = "name"
+	SortByEmail UserSortField = "email"
+)
+
+// UserOrder is a sort order for user listings. The zero value sorts by id ascending.
+type UserOrder struct {
+	Field UserSortField
+	Desc  bool
+}
+
+func NewUserOrder(field string, desc bool) (UserOrder, error) {
+	switch f := UserSortField(field); f {
+	case SortByID, SortByName, SortByEmail:
+		return UserOrder{Field: f, Desc: desc}, nil
+	}
+	return UserOrder{}, fmt.Errorf("cannot sort users by %q", field)
+}
+
+// entity: events
+type Event interface {
+	EventName() string
+}
+
+// UserCreated is published after a user has been stored.
+type UserCreated struct {
+	UserID int
+	Email  string
+}
+
+func (UserCreated) EventName() string { return "user.created" }
 
 // entity: data access interface
 type FindUserRepository interface {
+	// FindAll loads every user at once. Prefer FindPage for large tables.
 	FindAll(ctx context.Context) ([]*User, error)
+	FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error)
+	// FindPage loads at most limit users ordered by id, skipping offset users.
+	FindPage(ctx context.Context, limit int, offset int) ([]*User, error)
+	// FindAfter loads at most limit users whose id is greater than afterID,
+	// ordered by id. Unlike FindPage it is stable under concurrent inserts.
+	FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error)
+	FindByID(ctx context.Context, id int) (*User, error)
+	FindByEmail(ctx context.Context, email string) (*User, error)
+	FindByStatus(ctx context.Context, status Status) ([]*User, error)
+	Count(ctx context.Context) (int, error)
+}
+
+// RejectedUser is a stored row that is not a valid User.
+type RejectedUser struct {
+	ID  int
+	Err error
+}
+
+// LenientFindUserRepository loads every valid user and reports invalid rows
+// separately instead of failing the whole load.
+type LenientFindUserRepository interface {
+	FindAllLenient(ctx context.Context) ([]*User, []RejectedUser, error)
+}
+
+// ModifiedSinceUserRepository finds users whose row changed at or after a
+// point in time, for incremental exports.
+type ModifiedSinceUserRepository interface {
+	FindModifiedSince(ctx context.Context, t time.Time) ([]*User, error)
+}
+
+// StreamUserRepository reads users one at a time instead of all at once.
+// The user channel is closed when reading stops; the error channel then
+// yields at most one error and is closed as well.
+type StreamUserRepository interface {
+	FindAllStream(ctx context.Context) (<-chan *User, <-chan error)
 }
 type UploadUserRepository interface {
 	Upload(ctx context.Context, user *User) error
 }
 
+// SyncUserRepository is an UploadUserRepository that can report what it
+// already stores, so unchanged users can be skipped.
+type SyncUserRepository interface {
+	UploadUserRepository
+	// ListKeys returns the key of every stored object.
+	ListKeys(ctx context.Context) ([]string, error)
+	// StoredAs returns the object key and content hash Upload would produce.
+	StoredAs(user *User) (string, string, error)
+	// StoredHash returns the content hash recorded for the object at key, or
+	// "" if none was recorded.
+	StoredHash(ctx context.Context, key string) (string, error)
+}
+
+// ManifestUserRepository is an UploadUserRepository that can list what it
+// stored in a manifest object.
+type ManifestUserRepository interface {
+	UploadUserRepository
+	// ObjectKey returns the key Upload stores user under.
+	ObjectKey(user *User) (string, error)
+	WriteManifest(ctx context.Context, keys []string) error
+}
+
+// PreviewUserRepository describes what Upload would store without storing it.
+type PreviewUserRepository interface {
+	Preview(user *User) (key string, size int, err error)
+}
+type ExistsUserRepository interface {
+	Exists(ctx context.Context, id int) (bool, error)
+}
+
+// HashUploadUserRepository uploads like Upload and also returns the content
+// hash of what it stored.
+type HashUploadUserRepository interface {
+	UploadWithHash(ctx context.Context, user *User) (hash string, err error)
+}
+type CreateUserRepository interface {
+	Create(ctx context.Context, user *User) error
+}
+type BulkCreateUserRepository interface {
+	BulkCreate(ctx context.Context, users []*User) error
+}
+
+// UpsertUserRepository creates a user or updates the one stored under the
+// same email, reporting whether it was inserted.
+type UpsertUserRepository interface {
+	Upsert(ctx context.Context, user *User) (inserted bool, err error)
+}
+type DeleteUserRepository interface {
+	Delete(ctx context.Context, id int) error
+	// DeleteByStatus deletes every user with status and returns how many were deleted.
+	DeleteByStatus(ctx context.Context, status Status) (int, error)
+}
+type UpdateUserRepository interface {
+	Update(ctx context.Context, user *User) error
+}
+type ExportUserRepository interface {
+	Export(ctx context.Context, users []*User) error
+}
+
+// UserTx is a set of write repositories whose changes become visible together
+// on Commit, or not at all on Rollback.
+type UserTx interface {
+	CreateUserRepository
+	UpdateUserRepository
+	Commit() error
+	Rollback() error
+}
+type UnitOfWork interface {
+	BeginTx(ctx context.Context) (UserTx, error)
+}
+type EventPublisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// HealthChecker reports whether a dependency is reachable.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
+// IdempotencyStore remembers which operations have already been processed.
+type IdempotencyStore interface {
+	Seen(ctx context.Context, key string) (bool, error)
+	Mark(ctx context.Context, key string) error
+}
+
 // infrastructure
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateSQLIdentifier(kind string, name string) error {
+	if !sqlIdentifierPattern.MatchString(name) {
+		return fmt.Errorf("%s %q must contain only letters, digits and underscores", kind, name)
+	}
+	return nil
+}
+
+// PostgresTable is a validated schema-qualified table name.
+type PostgresTable struct {
+	name string
+}
+
+func NewPostgresTable(schema string, table string) (PostgresTable, error) {
+	if err := validateSQLIdentifier("schema", schema); err != nil {
+		return PostgresTable{}, err
+	}
+	if err := validateSQLIdentifier("table", table); err != nil {
+		return PostgresTable{}, err
+	}
+	return PostgresTable{name: schema + "." + table}, nil
+}
+
+type PostgresOption func(*postgresOptions)
+
+type postgresOptions struct {
+	table  PostgresTable
+	upsert bool
+}
+
+func newPostgresOptions(opts []PostgresOption) postgresOptions {
+	var o postgresOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.table.name == "" {
+		o.table.name = "app.user"
+	}
+	return o
+}
+
+// WithPostgresTable makes a Postgres repository use t instead of app.user.
+func WithPostgresTable(t PostgresTable) PostgresOption {
+	return func(o *postgresOptions) { o.table = t }
+}
+
+// WithUpsert makes the create repository update the name and status of the
+// user stored under the same email instead of failing with ErrDuplicateEmail.
+// Other repositories ignore it.
+func WithUpsert() PostgresOption {
+	return func(o *postgresOptions) { o.upsert = true }
+}
+
+func postgresTableName(opts []PostgresOption) string {
+	return newPostgresOptions(opts).table.name
+}
+
+// sortColumn maps order to a column name from a fixed whitelist.
+func sortColumn(order UserOrder) (string, error) {
+	columns := map[UserSortField]string{"": "id", SortByID: "id", SortByName: "name", SortByEmail: "email"}
+	column, ok := columns[order.Field]
+	if !ok {
+		return "", fmt.Errorf("cannot sort users by %q", order.Field)
+	}
+	return column, nil
+}
+
+// orderByClause turns order into an ORDER BY clause. Only whitelisted
+// columns are accepted, so the result is safe to concatenate into a query.
+func orderByClause(order UserOrder) (string, error) {
+	column, err := sortColumn(order)
+	if err != nil {
+		return "", err
+	}
+	if order.Desc {
+		return "ORDER BY " + column + " DESC", nil
+	}
+	return "ORDER BY " + column + " ASC", nil
+}
+
 type PostgresFindUserRepository struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	table string
+}
+
+func NewPostgresFindUserRepository(db *sqlx.DB, opts ...PostgresOption) FindUserRepository {
+	return &PostgresFindUserRepository{db: db, table: postgresTableName(opts)}
+}
+
+func (r PostgresFindUserRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
 }
 
-func NewPostgresFindUserRepository(db *sqlx.DB) FindUserRepository {
-	return &PostgresFindUserRepository{db: db}
+// Close closes db. Every repository built over the same db shares it, so
+// closing one of them is enough.
+func (r PostgresFindUserRepository) Close() error {
+	return r.db.Close()
 }
 
 type PostgresUser struct {
@@ -68,17 +531,14 @@ type PostgresUser struct {
 	Name       string `db:"name"`
 	Email      string `db:"email"`
 	StatusCode int    `db:"status_code"`
+	// UpdatedAt is only selected by FindModifiedSince; User has no such field.
+	UpdatedAt time.Time `db:"updated_at"`
 }
 
-func (r PostgresFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
-	query := `SELECT id, name, email, status_code FROM app.user`
-	var pgUsers []PostgresUser
-	if err := r.db.SelectContext(ctx, &pgUsers, query); err != nil {
-		return nil, err
-	}
+func toUsers(pgUsers []PostgresUser) ([]*User, error) {
 	var users []*User
 	for _, pgUser := range pgUsers {
-		user, err := NewUser(pgUser.Id, pgUser.Name, pgUser.Email, pgUser.StatusCode)
+		user, err := NewUser(pgUser.Id, pgUser.Name, pgUser.Email, Status(pgUser.StatusCode))
 		if err != nil {
 			return nil, err
 		}
@@ -87,128 +547,4215 @@ func (r PostgresFindUserRepository) FindAll(ctx context.Context) ([]*User, error
 	return users, nil
 }
 
-type S3UploadUserRepository struct {
-	client    *s3.Client
-	bucket    string
-	keyPrefix string
+// toUsersLenient is toUsers that collects invalid rows instead of failing.
+func toUsersLenient(pgUsers []PostgresUser) ([]*User, []RejectedUser) {
+	var users []*User
+	var rejected []RejectedUser
+	for _, pgUser := range pgUsers {
+		user, err := NewUser(pgUser.Id, pgUser.Name, pgUser.Email, Status(pgUser.StatusCode))
+		if err != nil {
+			rejected = append(rejected, RejectedUser{ID: pgUser.Id, Err: err})
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, rejected
 }
 
-func NewS3UploadUserRepository(client *s3.Client, bucket string, prefix string) UploadUserRepository {
-	return &S3UploadUserRepository{client: client, bucket: bucket, keyPrefix: prefix}
+func (r PostgresFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query); err != nil {
+		return nil, err
+	}
+	return toUsers(pgUsers)
 }
 
-type S3User struct {
-	Id         int    `json:"id"`
-	Name       string `json:"name"`
-	Email      string `json:"email"`
-	StatusCode int    `json:"status_code"`
+// FindAllDTO scans every row straight into a UserDTO, skipping the *User
+// FindAll builds. Each row is still checked with UserDTO.Validate.
+func (r PostgresFindUserRepository) FindAllDTO(ctx context.Context) ([]*UserDTO, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []UserDTO
+	for rows.Next() {
+		var dto UserDTO
+		if err := rows.Scan(&dto.ID, &dto.Name, &dto.Email, &dto.StatusCode); err != nil {
+			return nil, err
+		}
+		if err := dto.Validate(); err != nil {
+			return nil, fmt.Errorf("user id %d: %w", dto.ID, err)
+		}
+		dto.validated = true
+		values = append(values, dto)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	dtos := make([]*UserDTO, len(values))
+	for i := range values {
+		dtos[i] = &values[i]
+	}
+	return dtos, nil
 }
 
-func (r S3UploadUserRepository) Upload(ctx context.Context, user *User) error {
-	s3User := S3User{
-		Id:         user.ID(),
-		Name:       user.Name(),
-		Email:      user.Email(),
-		StatusCode: user.StatusCode(),
+func (r PostgresFindUserRepository) FindAllLenient(ctx context.Context) ([]*User, []RejectedUser, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query); err != nil {
+		return nil, nil, err
 	}
-	data, err := json.MarshalIndent(s3User, "", "  ")
+	users, rejected := toUsersLenient(pgUsers)
+	return users, rejected, nil
+}
+
+// FindAllStream scans the table row by row. The caller must drain the user
+// channel or cancel ctx, otherwise the producing goroutine blocks.
+func (r PostgresFindUserRepository) FindAllStream(ctx context.Context) (<-chan *User, <-chan error) {
+	users := make(chan *User)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(users)
+		query := `SELECT id, name, email, status_code FROM ` + r.table + ` ORDER BY id`
+		rows, err := r.db.QueryxContext(ctx, query)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var pgUser PostgresUser
+			if err := rows.StructScan(&pgUser); err != nil {
+				errs <- err
+				return
+			}
+			user, err := NewUser(pgUser.Id, pgUser.Name, pgUser.Email, Status(pgUser.StatusCode))
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case users <- user:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			errs <- err
+		}
+	}()
+	return users, errs
+}
+
+func (r PostgresFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	orderBy, err := orderByClause(order)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(r.bucket),
-		Key:         aws.String(fmt.Sprintf("%s/user-%d.json", r.keyPrefix, user.ID())),
-		Body:        bytes.NewReader(data),
-		ContentType: aws.String("application/json"),
-	})
-	if err != nil {
-		return err
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` ` + orderBy
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query); err != nil {
+		return nil, err
 	}
+	return toUsers(pgUsers)
+}
 
-	return nil
+func (r PostgresFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` ORDER BY id LIMIT $1 OFFSET $2`
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query, limit, offset); err != nil {
+		return nil, err
+	}
+	return toUsers(pgUsers)
 }
 
-// usecase dto (I/O boundary)
-type UserDTO struct {
-	ID         int
-	Name       string
-	Email      string
-	StatusCode int
+func (r PostgresFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE id > $1 ORDER BY id LIMIT $2`
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query, afterID, limit); err != nil {
+		return nil, err
+	}
+	return toUsers(pgUsers)
 }
 
-func userToDTO(u *User) *UserDTO {
-	return &UserDTO{
-		ID:         u.ID(),
-		Name:       u.Name(),
-		Email:      u.Email(),
-		StatusCode: u.StatusCode(),
+func (r PostgresFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE status_code = $1 ORDER BY id`
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query, int(status)); err != nil {
+		return nil, err
 	}
+	return toUsers(pgUsers)
 }
 
-func dtoToUser(dto *UserDTO) (*User, error) {
-	return NewUser(dto.ID, dto.Name, dto.Email, dto.StatusCode)
+// FindModifiedSince requires an updated_at column on the table.
+func (r PostgresFindUserRepository) FindModifiedSince(ctx context.Context, t time.Time) ([]*User, error) {
+	query := `SELECT id, name, email, status_code, updated_at FROM ` + r.table + ` WHERE updated_at >= $1 ORDER BY id`
+	var pgUsers []PostgresUser
+	if err := r.db.SelectContext(ctx, &pgUsers, query, t); err != nil {
+		return nil, err
+	}
+	return toUsers(pgUsers)
 }
 
-// usecase
-type FindAllUserUseCase struct{ repo FindUserRepository }
+func (r PostgresFindUserRepository) Count(ctx context.Context) (int, error) {
+	query := `SELECT COUNT(*) FROM ` + r.table
+	var n int
+	if err := r.db.GetContext(ctx, &n, query); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
 
-func NewFindAllUserUseCase(r FindUserRepository) *FindAllUserUseCase {
-	return &FindAllUserUseCase{repo: r}
+func (r PostgresFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE id = $1`
+	var pgUser PostgresUser
+	if err := r.db.GetContext(ctx, &pgUser, query, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+		}
+		return nil, err
+	}
+	return NewUser(pgUser.Id, pgUser.Name, pgUser.Email, Status(pgUser.StatusCode))
 }
 
-func (uc *FindAllUserUseCase) Run(ctx context.Context) ([]*UserDTO, error) {
-	users, err := uc.repo.FindAll(ctx)
+func (r PostgresFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	normalized, err := NewEmail(email)
 	if err != nil {
 		return nil, err
 	}
-	var dtos []*UserDTO
-	for _, u := range users {
-		dtos = append(dtos, userToDTO(u))
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE email = $1`
+	var pgUser PostgresUser
+	if err := r.db.GetContext(ctx, &pgUser, query, normalized.String()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user email %s: %w", normalized, ErrUserNotFound)
+		}
+		return nil, err
 	}
-	return dtos, nil
+	return NewUser(pgUser.Id, pgUser.Name, pgUser.Email, Status(pgUser.StatusCode))
 }
 
-type UploadUserUseCase struct {
-	repo UploadUserRepository
+type PostgresCreateUserRepository struct {
+	db     sqlx.ExtContext
+	table  string
+	upsert bool
 }
 
-func NewUploadUserUseCase(r UploadUserRepository) *UploadUserUseCase {
-	return &UploadUserUseCase{repo: r}
+func NewPostgresCreateUserRepository(db *sqlx.DB, opts ...PostgresOption) CreateUserRepository {
+	o := newPostgresOptions(opts)
+	return &PostgresCreateUserRepository{db: db, table: o.table.name, upsert: o.upsert}
 }
 
-func (uc *UploadUserUseCase) Run(ctx context.Context, dto *UserDTO) error {
-	u, err := dtoToUser(dto)
-	if err != nil {
-		return err
-	}
-	return uc.repo.Upload(ctx, u)
+func NewPostgresUpsertUserRepository(db *sqlx.DB, opts ...PostgresOption) UpsertUserRepository {
+	return &PostgresCreateUserRepository{db: db, table: postgresTableName(opts)}
 }
 
-func main() {
-	ctx := context.Background()
-	db, err := sqlx.Connect("postgres", "postgres://user@postgres.example.com/company")
+// Close closes the db the repository was built over. Inside a transaction
+// it has nothing to close.
+func (r PostgresCreateUserRepository) Close() error {
+	if c, ok := r.db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Create inserts the user. When the user has no id yet, the id assigned by
+// the database is written back to it. A taken email fails with
+// ErrDuplicateEmail and a taken id with ErrDuplicateUserID. With WithUpsert it
+// behaves like Upsert.
+func (r PostgresCreateUserRepository) Create(ctx context.Context, user *User) error {
+	if r.upsert {
+		_, err := r.Upsert(ctx, user)
+		return err
+	}
+	var err error
+	if user.ID() == 0 {
+		query := `INSERT INTO ` + r.table + ` (name, email, status_code) VALUES ($1, $2, $3) RETURNING id`
+		var id int
+		err = sqlx.GetContext(ctx, r.db, &id, query, user.Name(), user.Email(), int(user.StatusCode()))
+		if err == nil {
+			user.id = id
+		}
+	} else {
+		query := `INSERT INTO ` + r.table + ` (id, name, email, status_code) VALUES ($1, $2, $3, $4)`
+		_, err = r.db.ExecContext(ctx, query, user.ID(), user.Name(), user.Email(), int(user.StatusCode()))
+	}
+	if err != nil {
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+			return err
+		}
+		// Postgres names the constraints of a table t t_email_key and t_pkey
+		// unless the schema says otherwise.
+		_, table, _ := strings.Cut(r.table, ".")
+		switch pqErr.Constraint {
+		case table + "_email_key":
+			return fmt.Errorf("email %s: %w", user.Email(), ErrDuplicateEmail)
+		case table + "_pkey":
+			return fmt.Errorf("user id %d: %w", user.ID(), ErrDuplicateUserID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Upsert inserts the user, or updates the name and status of the user stored
+// under the same email. It reports whether a row was inserted and writes the
+// stored id back to user.
+func (r PostgresCreateUserRepository) Upsert(ctx context.Context, user *User) (bool, error) {
+	// xmax is 0 only for a row version created by an INSERT, so it tells an
+	// insert apart from the DO UPDATE branch.
+	conflict := ` ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name, status_code = EXCLUDED.status_code RETURNING id, (xmax = 0) AS inserted`
+	var row struct {
+		ID       int  `db:"id"`
+		Inserted bool `db:"inserted"`
+	}
+	var err error
+	if user.ID() == 0 {
+		query := `INSERT INTO ` + r.table + ` (name, email, status_code) VALUES ($1, $2, $3)` + conflict
+		err = sqlx.GetContext(ctx, r.db, &row, query, user.Name(), user.Email(), int(user.StatusCode()))
+	} else {
+		query := `INSERT INTO ` + r.table + ` (id, name, email, status_code) VALUES ($1, $2, $3, $4)` + conflict
+		err = sqlx.GetContext(ctx, r.db, &row, query, user.ID(), user.Name(), user.Email(), int(user.StatusCode()))
+	}
+	if err != nil {
+		return false, err
+	}
+	user.id = row.ID
+	return row.Inserted, nil
+}
+
+// PostgresBulkCreateUserRepository loads users with COPY inside a single
+// transaction, which is much faster than one INSERT per user.
+type PostgresBulkCreateUserRepository struct {
+	db    *sqlx.DB
+	table string
+}
+
+func NewPostgresBulkCreateUserRepository(db *sqlx.DB, opts ...PostgresOption) BulkCreateUserRepository {
+	return &PostgresBulkCreateUserRepository{db: db, table: postgresTableName(opts)}
+}
+
+func (r PostgresBulkCreateUserRepository) Close() error {
+	return r.db.Close()
+}
+
+// BulkCreate validates every user before the copy starts, so an invalid user
+// stores nothing. Each user must already have an id.
+func (r PostgresBulkCreateUserRepository) BulkCreate(ctx context.Context, users []*User) error {
+	for _, u := range users {
+		if _, err := NewUser(u.ID(), u.Name(), u.Email(), u.StatusCode()); err != nil {
+			return fmt.Errorf("user id %d: %w", u.ID(), err)
+		}
+	}
+	schema, table, _ := strings.Cut(r.table, ".")
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := copyUsers(ctx, tx, schema, table, users); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+func copyUsers(ctx context.Context, tx *sqlx.Tx, schema string, table string, users []*User) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(schema, table, "id", "name", "email", "status_code"))
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if _, err := stmt.ExecContext(ctx, u.ID(), u.Name(), u.Email(), int(u.StatusCode())); err != nil {
+			return errors.Join(err, stmt.Close())
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return errors.Join(err, stmt.Close())
+	}
+	return stmt.Close()
+}
+
+type PostgresDeleteUserRepository struct {
+	db    *sqlx.DB
+	table string
+}
+
+func NewPostgresDeleteUserRepository(db *sqlx.DB, opts ...PostgresOption) DeleteUserRepository {
+	return &PostgresDeleteUserRepository{db: db, table: postgresTableName(opts)}
+}
+
+func (r PostgresDeleteUserRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r PostgresDeleteUserRepository) Delete(ctx context.Context, id int) error {
+	query := `DELETE FROM ` + r.table + ` WHERE id = $1`
+	res, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+	}
+	return nil
+}
+
+func (r PostgresDeleteUserRepository) DeleteByStatus(ctx context.Context, status Status) (int, error) {
+	if !status.Valid() {
+		return 0, fmt.Errorf("status code %d is not valid", status)
+	}
+	query := `DELETE FROM ` + r.table + ` WHERE status_code = $1`
+	res, err := r.db.ExecContext(ctx, query, int(status))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+type PostgresUpdateUserRepository struct {
+	db    sqlx.ExtContext
+	table string
+}
+
+func NewPostgresUpdateUserRepository(db *sqlx.DB, opts ...PostgresOption) UpdateUserRepository {
+	return &PostgresUpdateUserRepository{db: db, table: postgresTableName(opts)}
+}
+
+// Close behaves like PostgresCreateUserRepository.Close.
+func (r PostgresUpdateUserRepository) Close() error {
+	if c, ok := r.db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r PostgresUpdateUserRepository) Update(ctx context.Context, user *User) error {
+	query := `UPDATE ` + r.table + ` SET name = $1, email = $2, status_code = $3 WHERE id = $4`
+	res, err := r.db.ExecContext(ctx, query, user.Name(), user.Email(), int(user.StatusCode()), user.ID())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user id %d: %w", user.ID(), ErrUserNotFound)
+	}
+	return nil
+}
+
+type PostgresUnitOfWork struct {
+	db     *sqlx.DB
+	table  string
+	upsert bool
+}
+
+func NewPostgresUnitOfWork(db *sqlx.DB, opts ...PostgresOption) UnitOfWork {
+	o := newPostgresOptions(opts)
+	return &PostgresUnitOfWork{db: db, table: o.table.name, upsert: o.upsert}
+}
+
+func (u PostgresUnitOfWork) BeginTx(ctx context.Context) (UserTx, error) {
+	tx, err := u.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresUserTx{
+		PostgresCreateUserRepository: PostgresCreateUserRepository{db: tx, table: u.table, upsert: u.upsert},
+		PostgresUpdateUserRepository: PostgresUpdateUserRepository{db: tx, table: u.table},
+		tx:                           tx,
+	}, nil
+}
+
+type postgresUserTx struct {
+	PostgresCreateUserRepository
+	PostgresUpdateUserRepository
+	tx *sqlx.Tx
+}
+
+func (t *postgresUserTx) Commit() error   { return t.tx.Commit() }
+func (t *postgresUserTx) Rollback() error { return t.tx.Rollback() }
+
+// PostgresIdempotencyStore keeps processed keys in app.upload_idempotency,
+// which needs a unique idempotency_key text column.
+type PostgresIdempotencyStore struct{ db *sqlx.DB }
+
+func NewPostgresIdempotencyStore(db *sqlx.DB) IdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+func (s PostgresIdempotencyStore) Seen(ctx context.Context, key string) (bool, error) {
+	var seen bool
+	query := `SELECT EXISTS (SELECT 1 FROM app.upload_idempotency WHERE idempotency_key = $1)`
+	if err := s.db.GetContext(ctx, &seen, query, key); err != nil {
+		return false, err
+	}
+	return seen, nil
+}
+
+func (s PostgresIdempotencyStore) Mark(ctx context.Context, key string) error {
+	query := `INSERT INTO app.upload_idempotency (idempotency_key) VALUES ($1) ON CONFLICT (idempotency_key) DO NOTHING`
+	_, err := s.db.ExecContext(ctx, query, key)
+	return err
+}
+
+// MySQLUser has the same column layout as PostgresUser.
+type MySQLUser = PostgresUser
+
+type MySQLFindUserRepository struct {
+	db    *sqlx.DB
+	table string
+}
+
+func NewMySQLFindUserRepository(db *sqlx.DB, schema string, table string) (FindUserRepository, error) {
+	if err := validateSQLIdentifier("schema", schema); err != nil {
+		return nil, err
+	}
+	if err := validateSQLIdentifier("table", table); err != nil {
+		return nil, err
+	}
+	return &MySQLFindUserRepository{db: db, table: fmt.Sprintf("`%s`.`%s`", schema, table)}, nil
+}
+
+func (r MySQLFindUserRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r MySQLFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query); err != nil {
+		return nil, err
+	}
+	return toUsers(myUsers)
+}
+
+func (r MySQLFindUserRepository) FindAllLenient(ctx context.Context) ([]*User, []RejectedUser, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query); err != nil {
+		return nil, nil, err
+	}
+	users, rejected := toUsersLenient(myUsers)
+	return users, rejected, nil
+}
+
+func (r MySQLFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	orderBy, err := orderByClause(order)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` ` + orderBy
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query); err != nil {
+		return nil, err
+	}
+	return toUsers(myUsers)
+}
+
+func (r MySQLFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` ORDER BY id LIMIT ? OFFSET ?`
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query, limit, offset); err != nil {
+		return nil, err
+	}
+	return toUsers(myUsers)
+}
+
+func (r MySQLFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE id > ? ORDER BY id LIMIT ?`
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query, afterID, limit); err != nil {
+		return nil, err
+	}
+	return toUsers(myUsers)
+}
+
+func (r MySQLFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE status_code = ? ORDER BY id`
+	var myUsers []MySQLUser
+	if err := r.db.SelectContext(ctx, &myUsers, query, int(status)); err != nil {
+		return nil, err
+	}
+	return toUsers(myUsers)
+}
+
+func (r MySQLFindUserRepository) Count(ctx context.Context) (int, error) {
+	query := `SELECT COUNT(*) FROM ` + r.table
+	var n int
+	if err := r.db.GetContext(ctx, &n, query); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (r MySQLFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE id = ?`
+	var myUser MySQLUser
+	if err := r.db.GetContext(ctx, &myUser, query, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+		}
+		return nil, err
+	}
+	return NewUser(myUser.Id, myUser.Name, myUser.Email, Status(myUser.StatusCode))
+}
+
+func (r MySQLFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	normalized, err := NewEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT id, name, email, status_code FROM ` + r.table + ` WHERE email = ?`
+	var myUser MySQLUser
+	if err := r.db.GetContext(ctx, &myUser, query, normalized.String()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user email %s: %w", normalized, ErrUserNotFound)
+		}
+		return nil, err
+	}
+	return NewUser(myUser.Id, myUser.Name, myUser.Email, Status(myUser.StatusCode))
+}
+
+// SQLiteFindUserRepository reads the user table of the main SQLite database.
+// SQLite accepts the backtick-quoted, ?-placeholder queries of
+// MySQLFindUserRepository, so it reuses them.
+type SQLiteFindUserRepository struct {
+	MySQLFindUserRepository
+}
+
+// NewSQLiteFindUserRepository takes an already-open database (driver
+// "sqlite"), so the caller decides on the file or DSN.
+func NewSQLiteFindUserRepository(db *sqlx.DB) FindUserRepository {
+	return &SQLiteFindUserRepository{MySQLFindUserRepository{db: db, table: "`main`.`user`"}}
+}
+
+// CachingFindUserRepository caches FindByID results for a fixed TTL in front
+// of another FindUserRepository. Concurrent misses for the same id share one
+// lookup. All other methods go straight to the wrapped repository.
+type CachingFindUserRepository struct {
+	FindUserRepository
+	size    int
+	ttl     time.Duration
+	clock   Clock
+	mu      sync.Mutex
+	entries map[int]cachedUser
+	gens    map[int]uint64
+	group   singleflight.Group
+}
+
+type cachedUser struct {
+	user      User
+	expiresAt time.Time
+}
+
+// NewCachingFindUserRepository expires entries by clock. A nil clock means
+// the wall clock.
+func NewCachingFindUserRepository(repo FindUserRepository, size int, ttl time.Duration, clock Clock) *CachingFindUserRepository {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &CachingFindUserRepository{
+		FindUserRepository: repo,
+		size:               size,
+		ttl:                ttl,
+		clock:              clock,
+		entries:            make(map[int]cachedUser),
+		gens:               make(map[int]uint64),
+	}
+}
+
+// FindByID serves the user from the cache, or looks it up once for every
+// concurrent caller. The shared lookup runs detached from the caller that
+// started it, so one caller giving up does not fail the others; each caller
+// still returns as soon as its own ctx is done.
+func (r *CachingFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	r.mu.Unlock()
+	if ok && r.clock.Now().Before(entry.expiresAt) {
+		u := entry.user
+		return &u, nil
+	}
+	lookupCtx := context.WithoutCancel(ctx)
+	ch := r.group.DoChan(strconv.Itoa(id), func() (any, error) {
+		r.mu.Lock()
+		gen := r.gens[id]
+		r.mu.Unlock()
+		u, err := r.FindUserRepository.FindByID(lookupCtx, id)
+		if err != nil {
+			return nil, err
+		}
+		r.store(id, gen, *u)
+		return *u, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		u := res.Val.(User)
+		return &u, nil
+	}
+}
+
+// store adds the user, evicting the entry closest to expiry when full. A
+// lookup that started before the id was last invalidated is not stored.
+func (r *CachingFindUserRepository) store(id int, gen uint64, u User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gens[id] != gen {
+		return
+	}
+	if _, ok := r.entries[id]; !ok && len(r.entries) >= r.size {
+		var oldest int
+		var oldestAt time.Time
+		for k, e := range r.entries {
+			if oldestAt.IsZero() || e.expiresAt.Before(oldestAt) {
+				oldest, oldestAt = k, e.expiresAt
+			}
+		}
+		delete(r.entries, oldest)
+	}
+	if r.size > 0 {
+		r.entries[id] = cachedUser{user: u, expiresAt: r.clock.Now().Add(r.ttl)}
+	}
+}
+
+// Invalidate drops the cached user, so the next FindByID looks it up again.
+// A lookup already in flight is not shared with later callers, and its
+// result is not cached.
+func (r *CachingFindUserRepository) Invalidate(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, id)
+	r.gens[id]++
+	r.group.Forget(strconv.Itoa(id))
+}
+
+// MongoUserCollection is the part of *mongo.Collection the Mongo repository
+// needs.
+type MongoUserCollection interface {
+	Find(ctx context.Context, filter any, opts ...options.Lister[options.FindOptions]) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter any, opts ...options.Lister[options.FindOneOptions]) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter any, opts ...options.Lister[options.CountOptions]) (int64, error)
+}
+
+type MongoUser struct {
+	Id         int    `bson:"id"`
+	Name       string `bson:"name"`
+	Email      string `bson:"email"`
+	StatusCode int    `bson:"status_code"`
+}
+
+type MongoFindUserRepository struct {
+	coll MongoUserCollection
+}
+
+func NewMongoFindUserRepository(coll MongoUserCollection) FindUserRepository {
+	return &MongoFindUserRepository{coll: coll}
+}
+
+func (r MongoFindUserRepository) find(ctx context.Context, filter any, opts ...options.Lister[options.FindOptions]) ([]*User, error) {
+	cursor, err := r.coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var mongoUsers []MongoUser
+	if err := cursor.All(ctx, &mongoUsers); err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, mongoUser := range mongoUsers {
+		user, err := NewUser(mongoUser.Id, mongoUser.Name, mongoUser.Email, Status(mongoUser.StatusCode))
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (r MongoFindUserRepository) findOne(ctx context.Context, filter any) (*User, error) {
+	var mongoUser MongoUser
+	if err := r.coll.FindOne(ctx, filter).Decode(&mongoUser); err != nil {
+		return nil, err
+	}
+	return NewUser(mongoUser.Id, mongoUser.Name, mongoUser.Email, Status(mongoUser.StatusCode))
+}
+
+func (r MongoFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	return r.find(ctx, bson.D{})
+}
+
+func (r MongoFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	column, err := sortColumn(order)
+	if err != nil {
+		return nil, err
+	}
+	direction := 1
+	if order.Desc {
+		direction = -1
+	}
+	return r.find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: column, Value: direction}}))
+}
+
+// FindPage returns no users for a zero limit rather than passing it on,
+// since Mongo reads a zero limit as no limit at all.
+func (r MongoFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	if err := validatePage(limit, offset); err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetLimit(int64(limit)).SetSkip(int64(offset))
+	return r.find(ctx, bson.D{}, opts)
+}
+
+// FindAfter treats a zero limit the way FindPage does.
+func (r MongoFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	if err := validatePage(limit, 0); err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetLimit(int64(limit))
+	return r.find(ctx, bson.D{{Key: "id", Value: bson.D{{Key: "$gt", Value: afterID}}}}, opts)
+}
+
+func (r MongoFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	u, err := r.findOne(ctx, bson.D{{Key: "id", Value: id}})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+	}
+	return u, err
+}
+
+func (r MongoFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	normalized, err := NewEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	u, err := r.findOne(ctx, bson.D{{Key: "email", Value: normalized.String()}})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("user email %s: %w", normalized, ErrUserNotFound)
+	}
+	return u, err
+}
+
+func (r MongoFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}})
+	return r.find(ctx, bson.D{{Key: "status_code", Value: int(status)}}, opts)
+}
+
+func (r MongoFindUserRepository) Count(ctx context.Context) (int, error) {
+	n, err := r.coll.CountDocuments(ctx, bson.D{})
+	return int(n), err
+}
+
+type InMemoryFindUserRepository struct {
+	users     []*User
+	updatedAt map[int]time.Time
+}
+
+func NewInMemoryFindUserRepository(users ...*User) FindUserRepository {
+	return &InMemoryFindUserRepository{users: append([]*User(nil), users...)}
+}
+
+// NewInMemoryModifiedSinceUserRepository is NewInMemoryFindUserRepository
+// that also knows when each user last changed, keyed by user id. A user
+// without a time is never returned by FindModifiedSince.
+func NewInMemoryModifiedSinceUserRepository(updatedAt map[int]time.Time, users ...*User) FindUserRepository {
+	return &InMemoryFindUserRepository{users: append([]*User(nil), users...), updatedAt: maps.Clone(updatedAt)}
+}
+
+func (r InMemoryFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	users := make([]*User, 0, len(r.users))
+	for _, u := range r.users {
+		copied := *u
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (r InMemoryFindUserRepository) FindAllStream(ctx context.Context) (<-chan *User, <-chan error) {
+	all, _ := r.FindAll(ctx)
+	users := make(chan *User)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(users)
+		for _, u := range all {
+			select {
+			case users <- u:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return users, errs
+}
+
+func (r InMemoryFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	var less func(a, b *User) bool
+	switch order.Field {
+	case "", SortByID:
+		less = func(a, b *User) bool { return a.ID() < b.ID() }
+	case SortByName:
+		less = func(a, b *User) bool { return a.Name() < b.Name() }
+	case SortByEmail:
+		less = func(a, b *User) bool { return a.Email() < b.Email() }
+	default:
+		return nil, fmt.Errorf("cannot sort users by %q", order.Field)
+	}
+	all, _ := r.FindAll(ctx)
+	sort.SliceStable(all, func(i, j int) bool {
+		if order.Desc {
+			return less(all[j], all[i])
+		}
+		return less(all[i], all[j])
+	})
+	return all, nil
+}
+
+// FindModifiedSince returns the users changed at or after t, ordered by id.
+func (r InMemoryFindUserRepository) FindModifiedSince(ctx context.Context, t time.Time) ([]*User, error) {
+	all, _ := r.FindAll(ctx)
+	sort.Slice(all, func(i, j int) bool { return all[i].ID() < all[j].ID() })
+	var users []*User
+	for _, u := range all {
+		if at, ok := r.updatedAt[u.ID()]; ok && !at.Before(t) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// validatePage rejects the negative limits and offsets that FindPage
+// implementations cannot serve.
+func validatePage(limit int, offset int) error {
+	if limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+	if offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	return nil
+}
+
+func (r InMemoryFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	if err := validatePage(limit, offset); err != nil {
+		return nil, err
+	}
+	all, _ := r.FindAll(ctx)
+	sort.Slice(all, func(i, j int) bool { return all[i].ID() < all[j].ID() })
+	if offset >= len(all) {
+		return nil, nil
+	}
+	all = all[offset:]
+	if limit < len(all) {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+func (r InMemoryFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	all, _ := r.FindAll(ctx)
+	sort.Slice(all, func(i, j int) bool { return all[i].ID() < all[j].ID() })
+	var users []*User
+	for _, u := range all {
+		if len(users) == limit {
+			break
+		}
+		if u.ID() > afterID {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (r InMemoryFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	all, _ := r.FindAll(ctx)
+	var users []*User
+	for _, u := range all {
+		if u.StatusCode() == status {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (r InMemoryFindUserRepository) Count(ctx context.Context) (int, error) {
+	return len(r.users), nil
+}
+
+func (r InMemoryFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	for _, u := range r.users {
+		if u.ID() == id {
+			copied := *u
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+}
+
+func (r InMemoryFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	normalized, err := NewEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range r.users {
+		if u.Email() == normalized.String() {
+			copied := *u
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("user email %s: %w", normalized, ErrUserNotFound)
+}
+
+// NewCSVFindUserRepository reads id,name,email,status_code rows from r, after
+// a header row, and serves them from memory. A row that is not a valid user
+// fails with its line number.
+func NewCSVFindUserRepository(r io.Reader) (FindUserRepository, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	if _, err := cr.Read(); err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+	var users []*User
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		u, err := csvRecordToUser(record)
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %w", line, err)
+		}
+		users = append(users, u)
+	}
+	return NewInMemoryFindUserRepository(users...), nil
+}
+
+func csvRecordToUser(record []string) (*User, error) {
+	id, err := strconv.Atoi(record[0])
+	if err != nil {
+		return nil, fmt.Errorf("id %q is not a number", record[0])
+	}
+	status, err := strconv.Atoi(record[3])
+	if err != nil {
+		return nil, fmt.Errorf("status code %q is not a number", record[3])
+	}
+	return NewUser(id, record[1], record[2], Status(status))
+}
+
+// HTTPFindUserRepository reads users from GET <baseURL>/users, which returns
+// a JSON array of users. The service has no query endpoints, so every method
+// fetches the full list and filters it locally.
+type HTTPFindUserRepository struct {
+	client  *http.Client
+	baseURL string
+}
+
+func NewHTTPFindUserRepository(client *http.Client, baseURL string) FindUserRepository {
+	return &HTTPFindUserRepository{client: client, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (r HTTPFindUserRepository) load(ctx context.Context) (FindUserRepository, error) {
+	url := r.baseURL + "/users"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	var records []S3User
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	users := make([]*User, 0, len(records))
+	for i, rec := range records {
+		u, err := NewUser(rec.Id, rec.Name, rec.Email, Status(rec.StatusCode))
+		if err != nil {
+			return nil, fmt.Errorf("GET %s: user %d: %w", url, i, err)
+		}
+		users = append(users, u)
+	}
+	return NewInMemoryFindUserRepository(users...), nil
+}
+
+func (r HTTPFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindAll(ctx)
+}
+
+func (r HTTPFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindAllSorted(ctx, order)
+}
+
+func (r HTTPFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindPage(ctx, limit, offset)
+}
+
+func (r HTTPFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindAfter(ctx, afterID, limit)
+}
+
+func (r HTTPFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindByID(ctx, id)
+}
+
+func (r HTTPFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindByEmail(ctx, email)
+}
+
+func (r HTTPFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return all.FindByStatus(ctx, status)
+}
+
+func (r HTTPFindUserRepository) Count(ctx context.Context) (int, error) {
+	all, err := r.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return all.Count(ctx)
+}
+
+// S3PutObjectAPI is the part of *s3.Client the upload repository needs.
+type S3PutObjectAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// S3GetObjectAPI is the part of *s3.Client needed to read objects back.
+type S3GetObjectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3 errors wrap the SDK error so callers can branch on the failure kind
+// while errors.As still reaches the original smithy.APIError.
+var (
+	ErrS3AccessDenied = errors.New("s3 access denied")
+	ErrS3Throttled    = errors.New("s3 request throttled")
+	ErrS3NotFound     = errors.New("s3 object or bucket not found")
+)
+
+// wrapS3Error classifies err by its API error code. Unknown codes and
+// non-API errors are returned unchanged.
+func wrapS3Error(err error) error {
+	var apiErr smithy.APIError
+	if err == nil || !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "Forbidden":
+		return fmt.Errorf("%w: %w", ErrS3AccessDenied, err)
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+		return fmt.Errorf("%w: %w", ErrS3Throttled, err)
+	case "NoSuchKey", "NoSuchBucket", "NotFound":
+		return fmt.Errorf("%w: %w", ErrS3NotFound, err)
+	}
+	return err
+}
+
+// defaultMultipartThreshold is the body size above which uploads switch to
+// the S3 manager's multipart Upload. A single PutObject is capped at 5 GiB.
+const defaultMultipartThreshold = 100 << 20
+
+type S3UploadUserRepository struct {
+	client             S3PutObjectAPI
+	bucket             string
+	keyPrefix          string
+	gzip               bool
+	kmsKeyID           string
+	keyTemplate        *template.Template
+	clock              Clock
+	multipartThreshold int64
+	fieldMap           map[string]string
+	contentDisposition bool
+	compactJSON        bool
+	verify             bool
+	maxPayloadBytes    int
+	redactEmail        bool
+	objectTags         bool
+	staticTags         map[string]string
+}
+
+type S3UploadOption func(*S3UploadUserRepository) error
+
+// WithGzip compresses the uploaded body and stores it under a .gz key.
+func WithGzip() S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.gzip = true
+		return nil
+	}
+}
+
+// WithSSEKMS encrypts uploaded objects server-side with the given KMS key.
+func WithSSEKMS(keyID string) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.kmsKeyID = keyID
+		return nil
+	}
+}
+
+// S3KeyData is the data a key template is executed against.
+type S3KeyData struct {
+	ID  int
+	Now time.Time
+}
+
+// WithKeyTemplate replaces the <prefix>/user-<id>.json key layout with a
+// text/template rendered from S3KeyData, e.g.
+// `users/{{.Now.Format "2006/01/02"}}/user-{{.ID}}.json`.
+func WithKeyTemplate(tmpl string) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		t, err := template.New("key").Option("missingkey=error").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("key template: %w", err)
+		}
+		if err := t.Execute(io.Discard, S3KeyData{}); err != nil {
+			return fmt.Errorf("key template: %w", err)
+		}
+		r.keyTemplate = t
+		return nil
+	}
+}
+
+// WithClock sets the clock used for time-based keys. It defaults to the wall clock.
+func WithClock(c Clock) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.clock = c
+		return nil
+	}
+}
+
+// WithMultipartThreshold sets the body size in bytes above which Upload uses a
+// multipart upload instead of PutObject. The client must also implement
+// manager.UploadAPIClient for multipart uploads to be used.
+func WithMultipartThreshold(n int64) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		if n <= 0 {
+			return errors.New("multipart threshold must be greater than 0")
+		}
+		r.multipartThreshold = n
+		return nil
+	}
+}
+
+// WithContentDisposition makes browsers download uploaded objects as
+// user-<id>.json instead of displaying them.
+func WithContentDisposition() S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.contentDisposition = true
+		return nil
+	}
+}
+
+// WithObjectTags tags every uploaded object with status=<status code> plus the
+// given static tags, so lifecycle rules can match on them. A static "status"
+// tag is overridden by the user's status.
+func WithObjectTags(static map[string]string) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.objectTags = true
+		r.staticTags = maps.Clone(static)
+		return nil
+	}
+}
+
+// objectTagging returns the URL-encoded Tagging value for user.
+func (r S3UploadUserRepository) objectTagging(user *User) string {
+	tags := url.Values{}
+	for k, v := range r.staticTags {
+		tags.Set(k, v)
+	}
+	tags.Set("status", strconv.Itoa(int(user.StatusCode())))
+	return tags.Encode()
+}
+
+// WithCompactJSON writes the JSON body without indentation. It can be
+// combined with WithGzip, which then compresses the compact body.
+func WithCompactJSON() S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.compactJSON = true
+		return nil
+	}
+}
+
+// WithVerify makes Upload read every object back after writing it and fail if
+// the stored bytes differ from the uploaded ones. The client must also
+// implement S3GetObjectAPI.
+func WithVerify() S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		if _, ok := r.client.(S3GetObjectAPI); !ok {
+			return errors.New("s3 client does not support GetObject")
+		}
+		r.verify = true
+		return nil
+	}
+}
+
+// WithMaxPayloadBytes makes Upload refuse a user whose JSON body is longer
+// than n bytes, before anything is sent. Without it there is no limit.
+func WithMaxPayloadBytes(n int) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		if n <= 0 {
+			return errors.New("max payload bytes must be greater than 0")
+		}
+		r.maxPayloadBytes = n
+		return nil
+	}
+}
+
+// S3Manifest is the <prefix>/manifest.json document.
+type S3Manifest struct {
+	Keys        []string  `json:"keys"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// WithEmailRedaction masks the local part of the uploaded email, e.g.
+// j***@example.com, for destinations that must not see full addresses. The
+// stored user is not changed.
+func WithEmailRedaction() S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		r.redactEmail = true
+		return nil
+	}
+}
+
+// s3UserFields are the S3User JSON keys in the order they are written.
+var s3UserFields = []string{"schema_version", "id", "name", "email", "status_code"}
+
+// WithFieldMap renames keys of the uploaded JSON, e.g. {"status_code": "state"}.
+// Keys left out of m keep their default name.
+func WithFieldMap(m map[string]string) S3UploadOption {
+	return func(r *S3UploadUserRepository) error {
+		names := make(map[string]string, len(s3UserFields))
+		for _, field := range s3UserFields {
+			names[field] = field
+		}
+		for from, to := range m {
+			if _, ok := names[from]; !ok {
+				return fmt.Errorf("field map: unknown field %q", from)
+			}
+			if to == "" {
+				return fmt.Errorf("field map: field %q must not be renamed to an empty name", from)
+			}
+			names[from] = to
+		}
+		seen := make(map[string]bool, len(names))
+		for _, to := range names {
+			if seen[to] {
+				return fmt.Errorf("field map: field name %q is used twice", to)
+			}
+			seen[to] = true
+		}
+		r.fieldMap = names
+		return nil
+	}
+}
+
+func NewS3UploadUserRepository(client S3PutObjectAPI, bucket string, prefix string, opts ...S3UploadOption) (UploadUserRepository, error) {
+	r := &S3UploadUserRepository{client: client, bucket: bucket, keyPrefix: prefix, clock: realClock{}, multipartThreshold: defaultMultipartThreshold}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// S3UserSchemaVersion is the version of the S3User layout being written.
+// Bump it whenever the layout changes so readers can branch on schema_version.
+const S3UserSchemaVersion = 1
+
+// S3User is the JSON shape of a user. User.MarshalJSON writes it, so the S3,
+// GCS, Azure and file backends all store the same document.
+type S3User struct {
+	SchemaVersion int    `json:"schema_version"`
+	Id            int    `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	StatusCode    int    `json:"status_code"`
+}
+
+func toS3User(user *User) S3User {
+	return S3User{
+		SchemaVersion: S3UserSchemaVersion,
+		Id:            user.ID(),
+		Name:          user.Name(),
+		Email:         user.Email(),
+		StatusCode:    int(user.StatusCode()),
+	}
+}
+
+func marshalUserJSON(user *User) ([]byte, error) {
+	return json.MarshalIndent(user, "", "  ")
+}
+
+// marshalUserJSONMapped marshals u with every key renamed through names,
+// keeping the default key order. Unless indent is set the output is compact.
+func marshalUserJSONMapped(u S3User, names map[string]string, indent bool) ([]byte, error) {
+	values := map[string]any{
+		"schema_version": u.SchemaVersion,
+		"id":             u.Id,
+		"name":           u.Name,
+		"email":          u.Email,
+		"status_code":    u.StatusCode,
+	}
+	var compact bytes.Buffer
+	compact.WriteByte('{')
+	for i, field := range s3UserFields {
+		if i > 0 {
+			compact.WriteByte(',')
+		}
+		key, err := json.Marshal(names[field])
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(values[field])
+		if err != nil {
+			return nil, err
+		}
+		compact.Write(key)
+		compact.WriteByte(':')
+		compact.Write(value)
+	}
+	compact.WriteByte('}')
+	if !indent {
+		return compact.Bytes(), nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, compact.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func userObjectKey(prefix string, id int) string {
+	return fmt.Sprintf("%s/user-%d.json", prefix, id)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// putObject stores input with PutObject, or with a multipart upload when the
+// body is larger than threshold and the client supports it.
+func putObject(ctx context.Context, client S3PutObjectAPI, input *s3.PutObjectInput, size int64, threshold int64) error {
+	if multipart, ok := client.(manager.UploadAPIClient); ok && size > threshold {
+		_, err := manager.NewUploader(multipart).Upload(ctx, input)
+		return wrapS3Error(err)
+	}
+	_, err := client.PutObject(ctx, input)
+	return wrapS3Error(err)
+}
+
+func (r S3UploadUserRepository) objectKey(id int) (string, error) {
+	key := userObjectKey(r.keyPrefix, id)
+	if r.keyTemplate != nil {
+		var b strings.Builder
+		if err := r.keyTemplate.Execute(&b, S3KeyData{ID: id, Now: r.clock.Now()}); err != nil {
+			return "", err
+		}
+		key = b.String()
+	}
+	if r.gzip {
+		key += ".gz"
+	}
+	return key, nil
+}
+
+func (r S3UploadUserRepository) marshal(user *User) ([]byte, error) {
+	u := toS3User(user)
+	if r.redactEmail {
+		u.Email = user.email.Masked()
+	}
+	if r.fieldMap != nil {
+		return marshalUserJSONMapped(u, r.fieldMap, !r.compactJSON)
+	}
+	if r.compactJSON {
+		return json.Marshal(u)
+	}
+	return json.MarshalIndent(u, "", "  ")
+}
+
+// encode returns the key and body Upload stores for user.
+func (r S3UploadUserRepository) encode(user *User) (string, []byte, error) {
+	data, err := r.marshal(user)
+	if err != nil {
+		return "", nil, err
+	}
+	if r.maxPayloadBytes > 0 && len(data) > r.maxPayloadBytes {
+		return "", nil, fmt.Errorf("user id %d: payload of %d bytes exceeds the limit of %d bytes", user.ID(), len(data), r.maxPayloadBytes)
+	}
+	key, err := r.objectKey(user.ID())
+	if err != nil {
+		return "", nil, err
+	}
+	if r.gzip {
+		if data, err = gzipBytes(data); err != nil {
+			return "", nil, err
+		}
+	}
+	return key, data, nil
+}
+
+func (r S3UploadUserRepository) Upload(ctx context.Context, user *User) error {
+	_, err := r.UploadWithHash(ctx, user)
+	return err
+}
+
+// UploadWithHash uploads user like Upload and returns the hex SHA-256 of the
+// stored body, which is also set as the content-sha256 object metadata.
+func (r S3UploadUserRepository) UploadWithHash(ctx context.Context, user *User) (string, error) {
+	key, data, err := r.encode(user)
+	if err != nil {
+		return "", err
+	}
+	hash := contentHash(data)
+	var contentEncoding *string
+	if r.gzip {
+		contentEncoding = aws.String("gzip")
+	}
+	input := &s3.PutObjectInput{
+		Bucket:          aws.String(r.bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(data),
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: contentEncoding,
+		Metadata:        map[string]string{contentHashMetadataKey: hash},
+	}
+	if r.contentDisposition {
+		input.ContentDisposition = aws.String(fmt.Sprintf(`attachment; filename="user-%d.json"`, user.ID()))
+	}
+	if r.kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(r.kmsKeyID)
+	}
+	if r.objectTags {
+		input.Tagging = aws.String(r.objectTagging(user))
+	}
+	if err := putObject(ctx, r.client, input, int64(len(data)), r.multipartThreshold); err != nil {
+		return "", err
+	}
+	if r.verify {
+		if err := r.verifyObject(ctx, key, data); err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+func (r S3UploadUserRepository) verifyObject(ctx context.Context, key string, want []byte) error {
+	getter := r.client.(S3GetObjectAPI)
+	out, err := getter.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(r.bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", key, wrapS3Error(err))
+	}
+	defer out.Body.Close()
+	got, err := io.ReadAll(out.Body)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", key, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("verify %s: stored %d bytes differ from the %d bytes uploaded", key, len(got), len(want))
+	}
+	return nil
+}
+
+func (r S3UploadUserRepository) ObjectKey(user *User) (string, error) {
+	return r.objectKey(user.ID())
+}
+
+// WriteManifest stores keys as <prefix>/manifest.json, stamped with the
+// current time of the repository's clock.
+func (r S3UploadUserRepository) WriteManifest(ctx context.Context, keys []string) error {
+	data, err := json.MarshalIndent(S3Manifest{Keys: keys, GeneratedAt: r.clock.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.keyPrefix + "/manifest.json"),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return wrapS3Error(err)
+}
+
+// Ping checks that the bucket is reachable. The client must also implement
+// s3.HeadBucketAPIClient.
+func (r S3UploadUserRepository) Ping(ctx context.Context) error {
+	header, ok := r.client.(s3.HeadBucketAPIClient)
+	if !ok {
+		return errors.New("s3 client does not support HeadBucket")
+	}
+	_, err := header.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.bucket)})
+	return wrapS3Error(err)
+}
+
+// Exists reports whether the user's object is already stored. The client must
+// also implement s3.HeadObjectAPIClient.
+func (r S3UploadUserRepository) Exists(ctx context.Context, id int) (bool, error) {
+	header, ok := r.client.(s3.HeadObjectAPIClient)
+	if !ok {
+		return false, errors.New("s3 client does not support HeadObject")
+	}
+	key, err := r.objectKey(id)
+	if err != nil {
+		return false, err
+	}
+	_, err = header.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		var apiErr smithy.APIError
+		if errors.As(err, &notFound) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+			return false, nil
+		}
+		return false, wrapS3Error(err)
+	}
+	return true, nil
+}
+
+func (r S3UploadUserRepository) Preview(user *User) (string, int, error) {
+	key, data, err := r.encode(user)
+	if err != nil {
+		return "", 0, err
+	}
+	return key, len(data), nil
+}
+
+// contentHashMetadataKey is the object metadata key holding contentHash of
+// the stored body.
+const contentHashMetadataKey = "content-sha256"
+
+// contentHash is the hex SHA-256 of a stored body. Unlike the ETag it does
+// not depend on encryption or on how many parts the object was uploaded in.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// StoredAs returns the key and the contentHash of the body Upload would store
+// for user, which Upload records as the content-sha256 metadata.
+func (r S3UploadUserRepository) StoredAs(user *User) (string, string, error) {
+	key, data, err := r.encode(user)
+	if err != nil {
+		return "", "", err
+	}
+	return key, contentHash(data), nil
+}
+
+// StoredHash reads the content-sha256 metadata of the object at key with
+// HeadObject. The client must also implement s3.HeadObjectAPIClient.
+func (r S3UploadUserRepository) StoredHash(ctx context.Context, key string) (string, error) {
+	header, ok := r.client.(s3.HeadObjectAPIClient)
+	if !ok {
+		return "", errors.New("s3 client does not support HeadObject")
+	}
+	out, err := header.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", wrapS3Error(err)
+	}
+	return out.Metadata[contentHashMetadataKey], nil
+}
+
+// ListKeys returns the key of every object under the key prefix. The client
+// must also implement s3.ListObjectsV2APIClient.
+func (r S3UploadUserRepository) ListKeys(ctx context.Context) ([]string, error) {
+	lister, ok := r.client.(s3.ListObjectsV2APIClient)
+	if !ok {
+		return nil, errors.New("s3 client does not support ListObjectsV2")
+	}
+	var keys []string
+	p := s3.NewListObjectsV2Paginator(lister, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.keyPrefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, wrapS3Error(err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+// S3DownloadAPI is the part of *s3.Client the download repository needs.
+type S3DownloadAPI interface {
+	s3.ListObjectsV2APIClient
+	S3GetObjectAPI
+}
+
+// S3DownloadUserRepository reads the <prefix>/user-<id>.json objects written
+// by S3UploadUserRepository with its default key layout.
+type S3DownloadUserRepository struct {
+	client    S3DownloadAPI
+	bucket    string
+	keyPrefix string
+}
+
+func NewS3DownloadUserRepository(client S3DownloadAPI, bucket string, prefix string) DownloadUserRepository {
+	return &S3DownloadUserRepository{client: client, bucket: bucket, keyPrefix: prefix}
+}
+
+// List skips objects under the prefix that are not user-<id>.json.
+func (r S3DownloadUserRepository) List(ctx context.Context) ([]int, error) {
+	var ids []int
+	p := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.keyPrefix + "/"),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, wrapS3Error(err)
+		}
+		for _, obj := range page.Contents {
+			if id, ok := parseUserObjectKey(r.keyPrefix, aws.ToString(obj.Key)); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// parseUserObjectKey is the inverse of userObjectKey.
+func parseUserObjectKey(prefix string, key string) (int, bool) {
+	name, ok := strings.CutPrefix(key, prefix+"/user-")
+	if !ok {
+		return 0, false
+	}
+	name, ok = strings.CutSuffix(name, ".json")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil || userObjectKey(prefix, id) != key {
+		return 0, false
+	}
+	return id, true
+}
+
+func (r S3DownloadUserRepository) Get(ctx context.Context, id int) (*UserDTO, error) {
+	key := userObjectKey(r.keyPrefix, id)
+	out, err := r.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(r.bucket), Key: aws.String(key)})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+		}
+		return nil, wrapS3Error(err)
+	}
+	defer out.Body.Close()
+	var stored S3User
+	if err := json.NewDecoder(out.Body).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	u, err := NewUser(stored.Id, stored.Name, stored.Email, Status(stored.StatusCode))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return userToDTO(u), nil
+}
+
+// XMLUser is the <user> document written by XMLUploadUserRepository.
+type XMLUser struct {
+	XMLName    xml.Name `xml:"user"`
+	Id         int      `xml:"id"`
+	Name       string   `xml:"name"`
+	Email      string   `xml:"email"`
+	StatusCode int      `xml:"status_code"`
+}
+
+// XMLUploadUserRepository stores each user as <prefix>/user-<id>.xml for
+// consumers that cannot read JSON.
+type XMLUploadUserRepository struct {
+	client    S3PutObjectAPI
+	bucket    string
+	keyPrefix string
+}
+
+func NewXMLUploadUserRepository(client S3PutObjectAPI, bucket string, prefix string) UploadUserRepository {
+	return &XMLUploadUserRepository{client: client, bucket: bucket, keyPrefix: prefix}
+}
+
+func (r XMLUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	data, err := xml.MarshalIndent(XMLUser{
+		Id:         user.ID(),
+		Name:       user.Name(),
+		Email:      user.Email(),
+		StatusCode: int(user.StatusCode()),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(fmt.Sprintf("%s/user-%d.xml", r.keyPrefix, user.ID())),
+		Body:        bytes.NewReader(append([]byte(xml.Header), data...)),
+		ContentType: aws.String("application/xml"),
+	})
+	return wrapS3Error(err)
+}
+
+type GCSUploadUserRepository struct {
+	client    *storage.Client
+	bucket    string
+	keyPrefix string
+}
+
+func NewGCSUploadUserRepository(client *storage.Client, bucket string, prefix string) UploadUserRepository {
+	return &GCSUploadUserRepository{client: client, bucket: bucket, keyPrefix: prefix}
+}
+
+func (r GCSUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	data, err := marshalUserJSON(user)
+	if err != nil {
+		return err
+	}
+	w := r.client.Bucket(r.bucket).Object(userObjectKey(r.keyPrefix, user.ID())).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+type AzureBlobUploadUserRepository struct {
+	client    *container.Client
+	keyPrefix string
+}
+
+func NewAzureBlobUploadUserRepository(client *container.Client, prefix string) UploadUserRepository {
+	return &AzureBlobUploadUserRepository{client: client, keyPrefix: prefix}
+}
+
+func (r AzureBlobUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	data, err := marshalUserJSON(user)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.NewBlockBlobClient(userObjectKey(r.keyPrefix, user.ID())).UploadBuffer(ctx, data, &blockblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to.Ptr("application/json")},
+	})
+	return err
+}
+
+// DynamoDBPutItemAPI is the part of *dynamodb.Client the DynamoDB repository needs.
+type DynamoDBPutItemAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// DynamoDBUser is the item layout; id is the partition key.
+type DynamoDBUser struct {
+	Id         int    `dynamodbav:"id"`
+	Name       string `dynamodbav:"name"`
+	Email      string `dynamodbav:"email"`
+	StatusCode int    `dynamodbav:"status_code"`
+}
+
+type DynamoDBUploadUserRepository struct {
+	client DynamoDBPutItemAPI
+	table  string
+}
+
+func NewDynamoDBUploadUserRepository(client DynamoDBPutItemAPI, table string) UploadUserRepository {
+	return &DynamoDBUploadUserRepository{client: client, table: table}
+}
+
+func (r DynamoDBUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	item, err := attributevalue.MarshalMap(DynamoDBUser{
+		Id:         user.ID(),
+		Name:       user.Name(),
+		Email:      user.Email(),
+		StatusCode: int(user.StatusCode()),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item:      item,
+	})
+	return err
+}
+
+type FileUploadUserRepository struct {
+	dir string
+}
+
+func NewFileUploadUserRepository(dir string) UploadUserRepository {
+	return &FileUploadUserRepository{dir: dir}
+}
+
+// Upload writes the user to a temporary file first and renames it into place,
+// so a crash never leaves a half-written user-<id>.json behind. The file is
+// synced before the rename and the directory after it, so the new name
+// survives a power loss too.
+func (r FileUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	data, err := marshalUserJSON(user)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.dir, ".user-*.json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(r.dir, fmt.Sprintf("user-%d.json", user.ID()))); err != nil {
+		return err
+	}
+	return syncDir(r.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RetryUploadUserRepository retries uploads that fail with a transient error,
+// waiting an exponentially growing, jittered delay between attempts.
+type RetryUploadUserRepository struct {
+	repo        UploadUserRepository
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+func NewRetryUploadUserRepository(repo UploadUserRepository, maxAttempts int, baseDelay time.Duration) UploadUserRepository {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryUploadUserRepository{repo: repo, maxAttempts: maxAttempts, baseDelay: baseDelay}
+}
+
+func (r RetryUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = r.repo.Upload(ctx, user)
+		if err == nil || attempt == r.maxAttempts || !isRetryableUploadError(err) {
+			return err
+		}
+		if sleepErr := sleepContext(ctx, backoffDelay(r.baseDelay, attempt)); sleepErr != nil {
+			return errors.Join(sleepErr, err)
+		}
+	}
+}
+
+// isRetryableUploadError reports whether err is a timeout, a 5xx response or
+// throttling, using the same classification as the AWS SDK retryer.
+func isRetryableUploadError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// maxBackoffDelay caps backoffDelay, however many attempts are made.
+const maxBackoffDelay = 30 * time.Second
+
+// backoffDelay returns base * 2^(attempt-1), capped at maxBackoffDelay, with
+// the upper half jittered. Doubling stops before it could overflow.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < attempt && d <= maxBackoffDelay/2; i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoffDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// RetryFindUserRepository retries reads that fail with a transient database
+// error, using the same backoff as RetryUploadUserRepository.
+type RetryFindUserRepository struct {
+	repo        FindUserRepository
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+func NewRetryFindUserRepository(repo FindUserRepository, maxAttempts int, baseDelay time.Duration) FindUserRepository {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryFindUserRepository{repo: repo, maxAttempts: maxAttempts, baseDelay: baseDelay}
+}
+
+func retryFind[T any](ctx context.Context, r RetryFindUserRepository, find func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := find()
+		if err == nil || attempt == r.maxAttempts || !isRetryableFindError(err) {
+			return v, err
+		}
+		if sleepErr := sleepContext(ctx, backoffDelay(r.baseDelay, attempt)); sleepErr != nil {
+			return v, errors.Join(sleepErr, err)
+		}
+	}
+}
+
+// transientPostgresCodes are pq error codes worth retrying: serialization
+// failures, deadlocks and a server shutting down or starting up. Connection
+// exceptions (class 08) are retried as well.
+var transientPostgresCodes = map[pq.ErrorCode]bool{
+	"40001": true,
+	"40P01": true,
+	"57P01": true,
+	"57P02": true,
+	"57P03": true,
+}
+
+// isRetryableFindError reports whether err is a timeout, a dropped or refused
+// connection or a transient Postgres error. Not-found and validation errors
+// are never retried.
+func isRetryableFindError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrUserNotFound) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || transientPostgresCodes[pqErr.Code]
+	}
+	return false
+}
+
+func (r RetryFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	return retryFind(ctx, r, func() ([]*User, error) { return r.repo.FindAll(ctx) })
+}
+
+func (r RetryFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	return retryFind(ctx, r, func() ([]*User, error) { return r.repo.FindAllSorted(ctx, order) })
+}
+
+func (r RetryFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	return retryFind(ctx, r, func() ([]*User, error) { return r.repo.FindPage(ctx, limit, offset) })
+}
+
+func (r RetryFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	return retryFind(ctx, r, func() ([]*User, error) { return r.repo.FindAfter(ctx, afterID, limit) })
+}
+
+func (r RetryFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	return retryFind(ctx, r, func() (*User, error) { return r.repo.FindByID(ctx, id) })
+}
+
+func (r RetryFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	return retryFind(ctx, r, func() (*User, error) { return r.repo.FindByEmail(ctx, email) })
+}
+
+func (r RetryFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	return retryFind(ctx, r, func() ([]*User, error) { return r.repo.FindByStatus(ctx, status) })
+}
+
+func (r RetryFindUserRepository) Count(ctx context.Context) (int, error) {
+	return retryFind(ctx, r, func() (int, error) { return r.repo.Count(ctx) })
+}
+
+// UploadMetrics holds the collectors recorded by MetricsUploadUserRepository.
+type UploadMetrics struct {
+	uploads  *prometheus.CounterVec
+	duration prometheus.Histogram
+}
+
+func NewUploadMetrics(reg prometheus.Registerer) (*UploadMetrics, error) {
+	m := &UploadMetrics{
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "user_uploads_total",
+			Help: "Number of user uploads by result.",
+		}, []string{"result"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "user_upload_duration_seconds",
+			Help:    "Duration of user uploads.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if err := reg.Register(m.uploads); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(m.duration); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type MetricsUploadUserRepository struct {
+	repo    UploadUserRepository
+	metrics *UploadMetrics
+}
+
+func NewMetricsUploadUserRepository(repo UploadUserRepository, metrics *UploadMetrics) UploadUserRepository {
+	return &MetricsUploadUserRepository{repo: repo, metrics: metrics}
+}
+
+func (r MetricsUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	start := time.Now()
+	err := r.repo.Upload(ctx, user)
+	r.metrics.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.metrics.uploads.WithLabelValues("failure").Inc()
+		return err
+	}
+	r.metrics.uploads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// DomainRoutingUploadUserRepository sends each user to the repository
+// registered for its email domain, e.g. partner.com users to their own bucket.
+// Users of any other domain go to the fallback.
+type DomainRoutingUploadUserRepository struct {
+	routes   map[string]UploadUserRepository
+	fallback UploadUserRepository
+}
+
+// NewDomainRoutingUploadUserRepository matches domains case-insensitively
+// against the host of the normalized email.
+func NewDomainRoutingUploadUserRepository(routes map[string]UploadUserRepository, fallback UploadUserRepository) UploadUserRepository {
+	normalized := make(map[string]UploadUserRepository, len(routes))
+	for domain, repo := range routes {
+		normalized[strings.ToLower(strings.TrimSpace(domain))] = repo
+	}
+	return &DomainRoutingUploadUserRepository{routes: normalized, fallback: fallback}
+}
+
+func (r DomainRoutingUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	email := user.Email()
+	domain := email[strings.LastIndexByte(email, '@')+1:]
+	if repo, ok := r.routes[domain]; ok {
+		return repo.Upload(ctx, user)
+	}
+	return r.fallback.Upload(ctx, user)
+}
+
+// MultiUploadUserRepository uploads every user to all of its repositories,
+// e.g. to S3 and GCS during a migration. A failing repository does not stop
+// the others; their errors are joined in repository order.
+type MultiUploadUserRepository struct {
+	repos    []UploadUserRepository
+	parallel bool
+}
+
+// NewMultiUploadUserRepository uploads to repos one after another, or all at
+// once when parallel is set.
+func NewMultiUploadUserRepository(parallel bool, repos ...UploadUserRepository) UploadUserRepository {
+	return &MultiUploadUserRepository{repos: append([]UploadUserRepository(nil), repos...), parallel: parallel}
+}
+
+func (r MultiUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	errs := make([]error, len(r.repos))
+	if !r.parallel {
+		for i, repo := range r.repos {
+			errs[i] = repo.Upload(ctx, user)
+		}
+		return errors.Join(errs...)
+	}
+	var wg sync.WaitGroup
+	for i, repo := range r.repos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = repo.Upload(ctx, user)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// CSVExportUserRepository writes users as CSV rows with an
+// id,name,email,status_code header.
+type CSVExportUserRepository struct {
+	w io.Writer
+}
+
+func NewCSVExportUserRepository(w io.Writer) ExportUserRepository {
+	return &CSVExportUserRepository{w: w}
+}
+
+func (r CSVExportUserRepository) Export(ctx context.Context, users []*User) error {
+	cw := csv.NewWriter(r.w)
+	if err := cw.Write([]string{"id", "name", "email", "status_code"}); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record := []string{strconv.Itoa(u.ID()), u.Name(), u.Email(), strconv.Itoa(int(u.StatusCode()))}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ParquetUser is one row of the Parquet export.
+type ParquetUser struct {
+	Id         int64  `parquet:"id"`
+	Name       string `parquet:"name"`
+	Email      string `parquet:"email"`
+	StatusCode int64  `parquet:"status_code"`
+}
+
+// parquetRowGroupSize is how many users ParquetExportUserRepository writes
+// per row group, and so the most rows it holds at once.
+const parquetRowGroupSize = 1024
+
+// ParquetExportUserRepository writes all users as a single Parquet file, one
+// row group per batch of users. With no users it still writes a valid file
+// carrying the schema.
+type ParquetExportUserRepository struct {
+	w            io.Writer
+	rowGroupSize int
+}
+
+func NewParquetExportUserRepository(w io.Writer) ExportUserRepository {
+	return &ParquetExportUserRepository{w: w, rowGroupSize: parquetRowGroupSize}
+}
+
+func (r ParquetExportUserRepository) Export(ctx context.Context, users []*User) error {
+	pw := parquet.NewGenericWriter[ParquetUser](r.w)
+	batch := make([]ParquetUser, 0, min(len(users), r.rowGroupSize))
+	flush := func() error {
+		if _, err := pw.Write(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return pw.Flush()
+	}
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = append(batch, ParquetUser{
+			Id:         int64(u.ID()),
+			Name:       u.Name(),
+			Email:      u.Email(),
+			StatusCode: int64(u.StatusCode()),
+		})
+		if len(batch) == r.rowGroupSize {
+			if err := flush(); err != nil {
+				return errors.Join(err, pw.Close())
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return errors.Join(err, pw.Close())
+		}
+	}
+	return pw.Close()
+}
+
+// NDJSONExportUserRepository writes users as newline-delimited JSON, one
+// S3User object per line.
+type NDJSONExportUserRepository struct {
+	w io.Writer
+}
+
+func NewNDJSONExportUserRepository(w io.Writer) ExportUserRepository {
+	return &NDJSONExportUserRepository{w: w}
+}
+
+func (r NDJSONExportUserRepository) Export(ctx context.Context, users []*User) error {
+	enc := json.NewEncoder(r.w)
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(toS3User(u)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type NDJSONFileExportUserRepository struct {
+	path string
+}
+
+func NewNDJSONFileExportUserRepository(path string) ExportUserRepository {
+	return &NDJSONFileExportUserRepository{path: path}
+}
+
+func (r NDJSONFileExportUserRepository) Export(ctx context.Context, users []*User) error {
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	if err := NewNDJSONExportUserRepository(f).Export(ctx, users); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// S3NDJSONExportUserRepository uploads all users as a single
+// <prefix>/users.ndjson object.
+// Bodies above the multipart threshold are sent as a multipart upload when
+// the client supports it.
+type S3NDJSONExportUserRepository struct {
+	client             S3PutObjectAPI
+	bucket             string
+	keyPrefix          string
+	multipartThreshold int64
+}
+
+func NewS3NDJSONExportUserRepository(client S3PutObjectAPI, bucket string, prefix string) ExportUserRepository {
+	return &S3NDJSONExportUserRepository{client: client, bucket: bucket, keyPrefix: prefix, multipartThreshold: defaultMultipartThreshold}
+}
+
+func (r S3NDJSONExportUserRepository) Export(ctx context.Context, users []*User) error {
+	var buf bytes.Buffer
+	if err := NewNDJSONExportUserRepository(&buf).Export(ctx, users); err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.keyPrefix + "/users.ndjson"),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	return putObject(ctx, r.client, input, int64(buf.Len()), r.multipartThreshold)
+}
+
+// CompositeHealthChecker runs every registered check and reports all failures.
+type CompositeHealthChecker struct {
+	names  []string
+	checks map[string]HealthChecker
+}
+
+func NewCompositeHealthChecker() *CompositeHealthChecker {
+	return &CompositeHealthChecker{checks: make(map[string]HealthChecker)}
+}
+
+// Register adds c under name. Registering a name again replaces its check.
+func (h *CompositeHealthChecker) Register(name string, c HealthChecker) {
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = c
+}
+
+// Ping runs the checks in registration order and joins their failures.
+func (h *CompositeHealthChecker) Ping(ctx context.Context) error {
+	var errs []error
+	for _, name := range h.names {
+		if err := h.checks[name].Ping(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AlwaysProcessIdempotencyStore never reports a key as seen.
+type AlwaysProcessIdempotencyStore struct{}
+
+func (AlwaysProcessIdempotencyStore) Seen(ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
+
+func (AlwaysProcessIdempotencyStore) Mark(ctx context.Context, key string) error { return nil }
+
+type InMemoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{keys: make(map[string]struct{})}
+}
+
+func (s *InMemoryIdempotencyStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[key]
+	return ok, nil
+}
+
+func (s *InMemoryIdempotencyStore) Mark(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = struct{}{}
+	return nil
+}
+
+// NoopEventPublisher drops every event.
+type NoopEventPublisher struct{}
+
+func (NoopEventPublisher) Publish(ctx context.Context, event Event) error { return nil }
+
+// InMemoryEventPublisher records published events.
+type InMemoryEventPublisher struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewInMemoryEventPublisher() *InMemoryEventPublisher {
+	return &InMemoryEventPublisher{}
+}
+
+func (p *InMemoryEventPublisher) Publish(ctx context.Context, event Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *InMemoryEventPublisher) Published() []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+type InMemoryUploadUserRepository struct {
+	mu       sync.Mutex
+	uploaded []*User
+	Err      error
+}
+
+func NewInMemoryUploadUserRepository() *InMemoryUploadUserRepository {
+	return &InMemoryUploadUserRepository{}
+}
+
+func (r *InMemoryUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	copied := *user
+	r.uploaded = append(r.uploaded, &copied)
+	return nil
+}
+
+func (r *InMemoryUploadUserRepository) Uploaded() []*User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*User(nil), r.uploaded...)
+}
+
+type InMemoryDeleteUserRepository struct {
+	mu    sync.Mutex
+	users []*User
+}
+
+func NewInMemoryDeleteUserRepository(users ...*User) *InMemoryDeleteUserRepository {
+	return &InMemoryDeleteUserRepository{users: append([]*User(nil), users...)}
+}
+
+func (r *InMemoryDeleteUserRepository) Delete(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, u := range r.users {
+		if u.ID() == id {
+			r.users = append(r.users[:i], r.users[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("user id %d: %w", id, ErrUserNotFound)
+}
+
+func (r *InMemoryDeleteUserRepository) DeleteByStatus(ctx context.Context, status Status) (int, error) {
+	if !status.Valid() {
+		return 0, fmt.Errorf("status code %d is not valid", status)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.users[:0]
+	for _, u := range r.users {
+		if u.StatusCode() != status {
+			kept = append(kept, u)
+		}
+	}
+	deleted := len(r.users) - len(kept)
+	r.users = kept
+	return deleted, nil
+}
+
+// Users returns the users that have not been deleted.
+func (r *InMemoryDeleteUserRepository) Users() []*User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*User(nil), r.users...)
+}
+
+// NoopDeadLetterSink drops failed users.
+type NoopDeadLetterSink struct{}
+
+func (NoopDeadLetterSink) Record(ctx context.Context, dto *UserDTO, err error) error { return nil }
+
+// DeadLetter is a user that failed to upload, as recorded by a DeadLetterSink.
+type DeadLetter struct {
+	User *UserDTO
+	Err  error
+}
+
+type InMemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func NewInMemoryDeadLetterSink() *InMemoryDeadLetterSink {
+	return &InMemoryDeadLetterSink{}
+}
+
+func (s *InMemoryDeadLetterSink) Record(ctx context.Context, dto *UserDTO, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *dto
+	s.letters = append(s.letters, DeadLetter{User: &copied, Err: err})
+	return nil
+}
+
+func (s *InMemoryDeadLetterSink) Recorded() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]DeadLetter(nil), s.letters...)
+}
+
+type deadLetterLine struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// JSONLFileDeadLetterSink appends each failed user and its error as one JSON
+// line to a local file.
+type JSONLFileDeadLetterSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewJSONLFileDeadLetterSink(path string) *JSONLFileDeadLetterSink {
+	return &JSONLFileDeadLetterSink{path: path}
+}
+
+func (s *JSONLFileDeadLetterSink) Record(ctx context.Context, dto *UserDTO, err error) error {
+	line, mErr := json.Marshal(deadLetterLine{
+		ID:         dto.ID,
+		Name:       dto.Name,
+		Email:      dto.Email,
+		StatusCode: dto.StatusCode,
+		Error:      err.Error(),
+	})
+	if mErr != nil {
+		return mErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, oErr := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if oErr != nil {
+		return oErr
+	}
+	if _, wErr := f.Write(append(line, '\n')); wErr != nil {
+		f.Close()
+		return wErr
+	}
+	return f.Close()
+}
+
+// usecase dto (I/O boundary)
+type UserDTO struct {
+	ID         int
+	Name       string
+	Email      string
+	StatusCode int
+	validated  bool
+}
+
+// ErrUnvalidatedDTO is returned by a usecase given a user DTO that did not
+// come from NewUserDTO, NewUnsavedUserDTO or another usecase.
+var ErrUnvalidatedDTO = errors.New("user dto was not built by NewUserDTO")
+
+func userToDTO(u *User) *UserDTO {
+	return &UserDTO{
+		ID:         u.ID(),
+		Name:       u.Name(),
+		Email:      u.Email(),
+		StatusCode: int(u.StatusCode()),
+		validated:  true,
+	}
+}
+
+// NewUserDTO builds a DTO that has passed the entity rules, with the email
+// normalized the way it will be stored. The usecases that take users as
+// input only accept DTOs built here, by NewUnsavedUserDTO or returned by
+// another usecase, and reject a struct literal with ErrUnvalidatedDTO. The
+// fields stay exported, so the usecases still check them again before
+// touching a repository.
+func NewUserDTO(id int, name string, email string, status int) (*UserDTO, error) {
+	u, err := NewUser(id, name, email, Status(status))
+	if err != nil {
+		return nil, err
+	}
+	return userToDTO(u), nil
+}
+
+// NewUnsavedUserDTO is NewUserDTO for a user the store has not assigned an
+// id to yet, as taken by CreateUserUseCase and UpsertUserUseCase.
+func NewUnsavedUserDTO(name string, email string, status int) (*UserDTO, error) {
+	u, err := NewUnsavedUser(name, email, Status(status))
+	if err != nil {
+		return nil, err
+	}
+	return userToDTO(u), nil
+}
+
+// Validate checks dto against the same rules as NewUser without building a User.
+func (dto *UserDTO) Validate() error {
+	if err := validateUserID(dto.ID); err != nil {
+		return err
+	}
+	_, _, err := validateUserFields(dto.Name, dto.Email, Status(dto.StatusCode))
+	return err
+}
+
+func dtoToUser(dto *UserDTO) (*User, error) {
+	return NewUser(dto.ID, dto.Name, dto.Email, Status(dto.StatusCode))
+}
+
+// UserMapper converts between a DTO version and the entity, so a new DTO
+// version only needs a new mapper.
+type UserMapper interface {
+	ToEntity(dto *UserDTO) (*User, error)
+	FromEntity(u *User) *UserDTO
+}
+
+// UserMapperV1 maps the current UserDTO one field to one field.
+type UserMapperV1 struct{}
+
+func (UserMapperV1) ToEntity(dto *UserDTO) (*User, error) { return dtoToUser(dto) }
+func (UserMapperV1) FromEntity(u *User) *UserDTO          { return userToDTO(u) }
+
+// uncheckedUserMapper is UserMapperV1 building users with NewUserUnchecked.
+type uncheckedUserMapper struct{ UserMapperV1 }
+
+func (uncheckedUserMapper) ToEntity(dto *UserDTO) (*User, error) {
+	return NewUserUnchecked(dto.ID, dto.Name, dto.Email, Status(dto.StatusCode)), nil
+}
+
+// DTOFindUserRepository loads users directly as validated DTOs, avoiding the
+// intermediate []*User on large tables.
+type DTOFindUserRepository interface {
+	FindAllDTO(ctx context.Context) ([]*UserDTO, error)
+}
+
+// DownloadUserRepository reads back users that were uploaded earlier.
+type DownloadUserRepository interface {
+	// List returns the ids of every stored user in key order.
+	List(ctx context.Context) ([]int, error)
+	Get(ctx context.Context, id int) (*UserDTO, error)
+}
+
+// DeadLetterSink keeps users that could not be uploaded so they are not lost.
+type DeadLetterSink interface {
+	Record(ctx context.Context, dto *UserDTO, err error) error
+}
+
+// usecase options
+type UseCaseOption func(*useCaseOptions)
+
+type useCaseOptions struct {
+	logger       *slog.Logger
+	timeout      time.Duration
+	skipExisting bool
+	dryRun       bool
+	publisher    EventPublisher
+	idempotency  IdempotencyStore
+	limiter      *rate.Limiter
+	lenient      bool
+	uniqueEmails bool
+	progress     func(done int, total int)
+	deadLetters  DeadLetterSink
+	mapper       UserMapper
+	partialOK    bool
+	checkpoint   func(offset int)
+}
+
+func newUseCaseOptions(opts []UseCaseOption) useCaseOptions {
+	o := useCaseOptions{
+		logger:      slog.New(slog.DiscardHandler),
+		publisher:   NoopEventPublisher{},
+		idempotency: AlwaysProcessIdempotencyStore{},
+		deadLetters: NoopDeadLetterSink{},
+		mapper:      UserMapperV1{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger makes the usecase log its progress. Without it, or with a nil l,
+// nothing is logged. Records logged with a ctx from WithCorrelationID carry a
+// correlation_id attribute.
+func WithLogger(l *slog.Logger) UseCaseOption {
+	return func(o *useCaseOptions) {
+		if l == nil {
+			return
+		}
+		o.logger = slog.New(correlationHandler{l.Handler()})
+	}
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying id, so every log line of
+// one batch run can be correlated.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+func correlationIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+func newCorrelationID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// correlationHandler adds the ctx correlation id to every record.
+type correlationHandler struct{ slog.Handler }
+
+func (h correlationHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id, ok := correlationIDFrom(ctx); ok {
+		rec = rec.Clone()
+		rec.AddAttrs(slog.String("correlation_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h correlationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationHandler) WithGroup(name string) slog.Handler {
+	return correlationHandler{h.Handler.WithGroup(name)}
+}
+
+// WithTimeout bounds every repository call made by the usecase by d, each
+// call getting its own deadline. A batch gets d per user, not d in total.
+// Reading a stream and the lifetime of a transaction are not bounded, since
+// they outlive any single call.
+func WithTimeout(d time.Duration) UseCaseOption {
+	return func(o *useCaseOptions) { o.timeout = d }
+}
+
+// WithSkipExisting makes the upload usecase check whether a user is already
+// stored and skip it if so. The upload repository must implement
+// ExistsUserRepository.
+func WithSkipExisting() UseCaseOption {
+	return func(o *useCaseOptions) { o.skipExisting = true }
+}
+
+// WithDryRun makes the upload usecase validate and log each user without
+// uploading it.
+func WithDryRun() UseCaseOption {
+	return func(o *useCaseOptions) { o.dryRun = true }
+}
+
+// WithEventPublisher makes the create usecase publish a UserCreated event for
+// every user it stores. Without it no events are published.
+func WithEventPublisher(p EventPublisher) UseCaseOption {
+	return func(o *useCaseOptions) { o.publisher = p }
+}
+
+// WithIdempotencyStore makes the upload usecase skip users whose id and
+// content were already uploaded according to s. Without it every user is
+// uploaded.
+func WithIdempotencyStore(s IdempotencyStore) UseCaseOption {
+	return func(o *useCaseOptions) { o.idempotency = s }
+}
+
+// WithRateLimit caps the upload usecase at rps uploads per second. Run blocks
+// until it may upload or ctx is done. A non-positive rps means no limit.
+func WithRateLimit(rps int) UseCaseOption {
+	return func(o *useCaseOptions) {
+		if rps <= 0 {
+			o.limiter = nil
+			return
+		}
+		o.limiter = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+}
+
+// ContinueOnInvalid makes the find-all usecase skip invalid stored users
+// instead of failing. The find repository must implement
+// LenientFindUserRepository.
+func ContinueOnInvalid() UseCaseOption {
+	return func(o *useCaseOptions) { o.lenient = true }
+}
+
+// WithUniqueEmails makes the batch upload usecase refuse a batch in which two
+// users share an email, before anything is uploaded.
+func WithUniqueEmails() UseCaseOption {
+	return func(o *useCaseOptions) { o.uniqueEmails = true }
+}
+
+// WithProgress makes the batch upload usecase call fn after every user,
+// whether it succeeded or not. Calls are serialized, so fn needs no locking.
+func WithProgress(fn func(done int, total int)) UseCaseOption {
+	return func(o *useCaseOptions) { o.progress = fn }
+}
+
+// WithDeadLetterSink makes the batch upload usecase record every user that
+// failed for good in sink. Users left unfinished because ctx is done are not
+// recorded.
+func WithDeadLetterSink(sink DeadLetterSink) UseCaseOption {
+	return func(o *useCaseOptions) { o.deadLetters = sink }
+}
+
+// WithMapper makes the usecase convert between DTOs and users with m instead
+// of UserMapperV1.
+func WithMapper(m UserMapper) UseCaseOption {
+	return func(o *useCaseOptions) { o.mapper = m }
+}
+
+// WithPartialManifest makes the manifest usecase write a manifest of the
+// users that did upload even when others failed. By default a failed user
+// means no manifest.
+func WithPartialManifest() UseCaseOption {
+	return func(o *useCaseOptions) { o.partialOK = true }
+}
+
+// WithUncheckedUsers makes the usecase build users from DTOs with
+// NewUserUnchecked, skipping validation, and accept DTOs that did not come
+// from NewUserDTO. It is unsafe: only use it for DTOs this program produced
+// itself. It replaces any mapper set by WithMapper.
+func WithUncheckedUsers() UseCaseOption {
+	return func(o *useCaseOptions) { o.mapper = uncheckedUserMapper{} }
+}
+
+// WithCheckpoint makes the chunked upload usecase call fn with the offset
+// of the next unprocessed user after every page. Passing that offset back to
+// Run resumes where the last run stopped.
+func WithCheckpoint(fn func(offset int)) UseCaseOption {
+	return func(o *useCaseOptions) { o.checkpoint = fn }
+}
+
+// checkDTO returns ErrUnvalidatedDTO for a dto that was not built by
+// NewUserDTO, NewUnsavedUserDTO or a usecase, unless the usecase was built
+// with WithUncheckedUsers.
+func (o useCaseOptions) checkDTO(dto *UserDTO) error {
+	if _, unchecked := o.mapper.(uncheckedUserMapper); dto.validated || unchecked {
+		return nil
+	}
+	return ErrUnvalidatedDTO
+}
+
+func (o useCaseOptions) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+// usecase
+type FindAllUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindAllUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindAllUserUseCase {
+	return &FindAllUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run returns every user. With ContinueOnInvalid, invalid users are logged
+// and left out; use RunWithRejected to get them.
+func (uc *FindAllUserUseCase) Run(ctx context.Context) ([]*UserDTO, error) {
+	dtos, _, err := uc.RunWithRejected(ctx)
+	return dtos, err
+}
+
+// RunWithRejected is Run that also returns the invalid users skipped under
+// ContinueOnInvalid. Without that option nothing is ever rejected.
+func (uc *FindAllUserUseCase) RunWithRejected(ctx context.Context) ([]*UserDTO, []RejectedUser, error) {
+	uc.opts.logger.InfoContext(ctx, "find all users started")
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	users, rejected, err := uc.findAll(opCtx)
+	if err != nil {
+		uc.opts.logger.ErrorContext(ctx, "find all users failed", slog.Any("error", err))
+		return nil, nil, err
+	}
+	for _, rej := range rejected {
+		uc.opts.logger.WarnContext(ctx, "find all users rejected user", slog.Int("user_id", rej.ID), slog.Any("error", rej.Err))
+	}
+	var dtos []*UserDTO
+	for _, u := range users {
+		dtos = append(dtos, uc.opts.mapper.FromEntity(u))
+	}
+	uc.opts.logger.InfoContext(ctx, "find all users finished", slog.Int("count", len(dtos)), slog.Int("rejected", len(rejected)))
+	return dtos, rejected, nil
+}
+
+// RunDTO is Run reading DTOs directly when the repository implements
+// DTOFindUserRepository. Otherwise, or under ContinueOnInvalid, it is Run.
+func (uc *FindAllUserUseCase) RunDTO(ctx context.Context) ([]*UserDTO, error) {
+	direct, ok := uc.repo.(DTOFindUserRepository)
+	if !ok || uc.opts.lenient {
+		return uc.Run(ctx)
+	}
+	uc.opts.logger.InfoContext(ctx, "find all users started")
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	dtos, err := direct.FindAllDTO(opCtx)
+	if err != nil {
+		uc.opts.logger.ErrorContext(ctx, "find all users failed", slog.Any("error", err))
+		return nil, err
+	}
+	uc.opts.logger.InfoContext(ctx, "find all users finished", slog.Int("count", len(dtos)))
+	return dtos, nil
+}
+
+func (uc *FindAllUserUseCase) findAll(ctx context.Context) ([]*User, []RejectedUser, error) {
+	if !uc.opts.lenient {
+		users, err := uc.repo.FindAll(ctx)
+		return users, nil, err
+	}
+	lenient, ok := uc.repo.(LenientFindUserRepository)
+	if !ok {
+		return nil, nil, errors.New("find repository cannot skip invalid users")
+	}
+	return lenient.FindAllLenient(ctx)
+}
+
+// RunSorted is Run with the users ordered by sortBy ("id", "name" or "email").
+func (uc *FindAllUserUseCase) RunSorted(ctx context.Context, sortBy string, desc bool) ([]*UserDTO, error) {
+	order, err := NewUserOrder(sortBy, desc)
+	if err != nil {
+		return nil, err
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	users, err := uc.repo.FindAllSorted(opCtx, order)
+	if err != nil {
+		uc.opts.logger.ErrorContext(ctx, "find all users failed", slog.Any("error", err))
+		return nil, err
+	}
+	var dtos []*UserDTO
+	for _, u := range users {
+		dtos = append(dtos, uc.opts.mapper.FromEntity(u))
+	}
+	return dtos, nil
+}
+
+// FindAllMapUserUseCase loads every user keyed by id for O(1) lookups.
+type FindAllMapUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindAllMapUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindAllMapUserUseCase {
+	return &FindAllMapUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run fails if two users share an id, which means the store is corrupt.
+func (uc *FindAllMapUserUseCase) Run(ctx context.Context) (map[int]*UserDTO, error) {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	users, err := uc.repo.FindAll(opCtx)
+	if err != nil {
+		return nil, err
+	}
+	dtos := make(map[int]*UserDTO, len(users))
+	for _, u := range users {
+		if _, ok := dtos[u.ID()]; ok {
+			return nil, fmt.Errorf("user id %d is stored more than once", u.ID())
+		}
+		dtos[u.ID()] = uc.opts.mapper.FromEntity(u)
+	}
+	return dtos, nil
+}
+
+type FindPageUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindPageUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindPageUserUseCase {
+	return &FindPageUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run returns one page of users together with the total number of users.
+func (uc *FindPageUserUseCase) Run(ctx context.Context, limit int, offset int) ([]*UserDTO, int, error) {
+	if err := validatePage(limit, offset); err != nil {
+		return nil, 0, err
+	}
+	pageCtx, cancelPage := uc.opts.operationContext(ctx)
+	defer cancelPage()
+	users, err := uc.repo.FindPage(pageCtx, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	countCtx, cancelCount := uc.opts.operationContext(ctx)
+	defer cancelCount()
+	total, err := uc.repo.Count(countCtx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dtos []*UserDTO
+	for _, u := range users {
+		dtos = append(dtos, uc.opts.mapper.FromEntity(u))
+	}
+	return dtos, total, nil
+}
+
+type FindAfterUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindAfterUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindAfterUserUseCase {
+	return &FindAfterUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run returns the users after the cursor and the cursor for the next call.
+// Fewer than limit users means the end has been reached.
+func (uc *FindAfterUserUseCase) Run(ctx context.Context, afterID int, limit int) ([]*UserDTO, int, error) {
+	if limit < 1 {
+		return nil, 0, errors.New("limit must be greater than 0")
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	users, err := uc.repo.FindAfter(opCtx, afterID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := afterID
+	var dtos []*UserDTO
+	for _, u := range users {
+		dtos = append(dtos, uc.opts.mapper.FromEntity(u))
+		next = u.ID()
+	}
+	return dtos, next, nil
+}
+
+type FindByStatusUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindByStatusUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindByStatusUserUseCase {
+	return &FindByStatusUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *FindByStatusUserUseCase) Run(ctx context.Context, status int) ([]*UserDTO, error) {
+	if !Status(status).Valid() {
+		return nil, fmt.Errorf("status code %d is not valid", status)
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	users, err := uc.repo.FindByStatus(opCtx, Status(status))
+	if err != nil {
+		return nil, err
+	}
+	var dtos []*UserDTO
+	for _, u := range users {
+		dtos = append(dtos, uc.opts.mapper.FromEntity(u))
+	}
+	return dtos, nil
+}
+
+type CountUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewCountUserUseCase(r FindUserRepository, opts ...UseCaseOption) *CountUserUseCase {
+	return &CountUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *CountUserUseCase) Run(ctx context.Context) (int, error) {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.repo.Count(opCtx)
+}
+
+type FindByIDUserUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindByIDUserUseCase(r FindUserRepository, opts ...UseCaseOption) *FindByIDUserUseCase {
+	return &FindByIDUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *FindByIDUserUseCase) Run(ctx context.Context, id int) (*UserDTO, error) {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	u, err := uc.repo.FindByID(opCtx, id)
+	if err != nil {
+		return nil, err
+	}
+	return uc.opts.mapper.FromEntity(u), nil
+}
+
+type FindUserByEmailUseCase struct {
+	repo FindUserRepository
+	opts useCaseOptions
+}
+
+func NewFindUserByEmailUseCase(r FindUserRepository, opts ...UseCaseOption) *FindUserByEmailUseCase {
+	return &FindUserByEmailUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *FindUserByEmailUseCase) Run(ctx context.Context, email string) (*UserDTO, error) {
+	if _, err := NewEmail(email); err != nil {
+		return nil, err
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	u, err := uc.repo.FindByEmail(opCtx, email)
+	if err != nil {
+		return nil, err
+	}
+	return uc.opts.mapper.FromEntity(u), nil
+}
+
+type UploadUserUseCase struct {
+	repo UploadUserRepository
+	opts useCaseOptions
+}
+
+func NewUploadUserUseCase(r UploadUserRepository, opts ...UseCaseOption) *UploadUserUseCase {
+	return &UploadUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *UploadUserUseCase) Run(ctx context.Context, dto *UserDTO) error {
+	logger := uc.opts.logger.With(slog.Int("user_id", dto.ID))
+	logger.InfoContext(ctx, "upload user started")
+	if err := uc.opts.checkDTO(dto); err != nil {
+		logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+		return err
+	}
+	u, err := uc.opts.mapper.ToEntity(dto)
+	if err != nil {
+		logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+		return err
+	}
+	if uc.opts.dryRun {
+		return uc.preview(ctx, logger, u)
+	}
+	if uc.opts.skipExisting {
+		exists, err := uc.exists(ctx, u.ID())
+		if err != nil {
+			logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+			return err
+		}
+		if exists {
+			logger.InfoContext(ctx, "upload user skipped: already exists")
+			return nil
+		}
+	}
+	var key string
+	if uc.tracksIdempotency() {
+		key, err = idempotencyKey(u)
+		if err != nil {
+			logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+			return err
+		}
+		seen, err := uc.seen(ctx, key)
+		if err != nil {
+			logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+			return err
+		}
+		if seen {
+			logger.InfoContext(ctx, "upload user skipped: already processed")
+			return nil
+		}
+	}
+	if uc.opts.limiter != nil {
+		if err := uc.opts.limiter.Wait(ctx); err != nil {
+			logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+			return err
+		}
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	if err := uc.repo.Upload(opCtx, u); err != nil {
+		logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+		return err
+	}
+	if uc.tracksIdempotency() {
+		if err := uc.mark(ctx, key); err != nil {
+			logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+			return err
+		}
+	}
+	logger.InfoContext(ctx, "upload user finished")
+	return nil
+}
+
+// idempotencyKey identifies an upload by the user id and a SHA-256 of its
+// JSON, so a changed user is uploaded again.
+func idempotencyKey(u *User) (string, error) {
+	data, err := marshalUserJSON(u)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d:%s", u.ID(), hex.EncodeToString(sum[:])), nil
+}
+
+// tracksIdempotency reports whether a store that remembers keys is configured.
+// With the default AlwaysProcessIdempotencyStore hashing every user would be
+// wasted work.
+func (uc *UploadUserUseCase) tracksIdempotency() bool {
+	_, always := uc.opts.idempotency.(AlwaysProcessIdempotencyStore)
+	return !always
+}
+
+func (uc *UploadUserUseCase) seen(ctx context.Context, key string) (bool, error) {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.opts.idempotency.Seen(opCtx, key)
+}
+
+func (uc *UploadUserUseCase) mark(ctx context.Context, key string) error {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.opts.idempotency.Mark(opCtx, key)
+}
+
+func (uc *UploadUserUseCase) preview(ctx context.Context, logger *slog.Logger, u *User) error {
+	previewer, ok := uc.repo.(PreviewUserRepository)
+	if !ok {
+		logger.InfoContext(ctx, "upload user dry run")
+		return nil
+	}
+	key, size, err := previewer.Preview(u)
+	if err != nil {
+		logger.ErrorContext(ctx, "upload user failed", slog.Any("error", err))
+		return err
+	}
+	logger.InfoContext(ctx, "upload user dry run", slog.String("key", key), slog.Int("size", size))
+	return nil
+}
+
+func (uc *UploadUserUseCase) exists(ctx context.Context, id int) (bool, error) {
+	checker, ok := uc.repo.(ExistsUserRepository)
+	if !ok {
+		return false, errors.New("upload repository cannot check whether a user exists")
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return checker.Exists(opCtx, id)
+}
+
+// RunAll uploads every dto in order. A failed user does not stop the rest;
+// the failures are returned together via errors.Join. Once ctx is done no
+// further user is started and ctx.Err() is included in the result.
+func (uc *UploadUserUseCase) RunAll(ctx context.Context, dtos []*UserDTO) error {
+	var errs []error
+	for _, dto := range dtos {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := uc.Run(ctx, dto); err != nil {
+			errs = append(errs, fmt.Errorf("user id %d: %w", dto.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SequentialUploadUserUseCase uploads users one at a time and stops at the
+// first failure. Unlike RunAll it does not carry on past a failed user.
+type SequentialUploadUserUseCase struct{ upload *UploadUserUseCase }
+
+func NewSequentialUploadUserUseCase(r UploadUserRepository, opts ...UseCaseOption) *SequentialUploadUserUseCase {
+	return &SequentialUploadUserUseCase{upload: NewUploadUserUseCase(r, opts...)}
+}
+
+// Run checks ctx before every user, so a cancellation stops the loop before
+// the next upload starts.
+func (uc *SequentialUploadUserUseCase) Run(ctx context.Context, dtos []*UserDTO) error {
+	for _, dto := range dtos {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := uc.upload.Run(ctx, dto); err != nil {
+			return fmt.Errorf("user id %d: %w", dto.ID, err)
+		}
+	}
+	return nil
+}
+
+// ChunkedUploadUserUseCase loads users one page at a time and uploads each
+// page before fetching the next, so a crash loses at most one page of
+// progress.
+type ChunkedUploadUserUseCase struct {
+	find      FindUserRepository
+	upload    *UploadUserUseCase
+	batchSize int
+}
+
+func NewChunkedUploadUserUseCase(f FindUserRepository, u UploadUserRepository, batchSize int, opts ...UseCaseOption) *ChunkedUploadUserUseCase {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &ChunkedUploadUserUseCase{find: f, upload: NewUploadUserUseCase(u, opts...), batchSize: batchSize}
+}
+
+// Run starts at offset and stops at the first failed upload. The checkpoint
+// is only advanced once a whole page has been uploaded.
+func (uc *ChunkedUploadUserUseCase) Run(ctx context.Context, offset int) error {
+	if offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	for {
+		opCtx, cancel := uc.upload.opts.operationContext(ctx)
+		users, err := uc.find.FindPage(opCtx, uc.batchSize, offset)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("page at offset %d: %w", offset, err)
+		}
+		for _, u := range users {
+			if err := uc.upload.Run(ctx, uc.upload.opts.mapper.FromEntity(u)); err != nil {
+				return fmt.Errorf("user id %d: %w", u.ID(), err)
+			}
+		}
+		offset += len(users)
+		if uc.upload.opts.checkpoint != nil && len(users) > 0 {
+			uc.upload.opts.checkpoint(offset)
+		}
+		if len(users) < uc.batchSize {
+			return nil
+		}
+	}
+}
+
+// ManifestUploadUserUseCase uploads a batch and then writes a manifest
+// listing the keys of the uploaded users.
+type ManifestUploadUserUseCase struct {
+	repo   ManifestUserRepository
+	upload *UploadUserUseCase
+}
+
+func NewManifestUploadUserUseCase(r ManifestUserRepository, opts ...UseCaseOption) *ManifestUploadUserUseCase {
+	return &ManifestUploadUserUseCase{repo: r, upload: NewUploadUserUseCase(r, opts...)}
+}
+
+// Run keeps going after a failed user like RunAll. The manifest is written
+// only if every user uploaded, unless WithPartialManifest is set, and never
+// in a dry run.
+func (uc *ManifestUploadUserUseCase) Run(ctx context.Context, dtos []*UserDTO) error {
+	var errs []error
+	var keys []string
+	for _, dto := range dtos {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := uc.upload.Run(ctx, dto); err != nil {
+			errs = append(errs, fmt.Errorf("user id %d: %w", dto.ID, err))
+			continue
+		}
+		u, err := uc.upload.opts.mapper.ToEntity(dto)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user id %d: %w", dto.ID, err))
+			continue
+		}
+		key, err := uc.repo.ObjectKey(u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user id %d: %w", dto.ID, err))
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if uc.upload.opts.dryRun || (len(errs) > 0 && !uc.upload.opts.partialOK) {
+		return errors.Join(errs...)
+	}
+	opCtx, cancel := uc.upload.opts.operationContext(ctx)
+	defer cancel()
+	if err := uc.repo.WriteManifest(opCtx, keys); err != nil {
+		errs = append(errs, fmt.Errorf("write manifest: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+type ExportUsersUseCase struct {
+	repo ExportUserRepository
+	opts useCaseOptions
+}
+
+func NewExportUsersUseCase(r ExportUserRepository, opts ...UseCaseOption) *ExportUsersUseCase {
+	return &ExportUsersUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *ExportUsersUseCase) Run(ctx context.Context, dtos []*UserDTO) error {
+	users := make([]*User, 0, len(dtos))
+	for _, dto := range dtos {
+		if err := uc.opts.checkDTO(dto); err != nil {
+			return err
+		}
+		u, err := uc.opts.mapper.ToEntity(dto)
+		if err != nil {
+			return err
+		}
+		users = append(users, u)
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.repo.Export(opCtx, users)
+}
+
+// NewParquetExportUseCase exports users as a single Parquet file written to w,
+// for analytics jobs that read columnar data.
+func NewParquetExportUseCase(w io.Writer, opts ...UseCaseOption) *ExportUsersUseCase {
+	return NewExportUsersUseCase(NewParquetExportUserRepository(w), opts...)
+}
+
+// StreamUploadUserUseCase uploads users as they are read, so the whole table
+// is never held in memory.
+type StreamUploadUserUseCase struct {
+	find   StreamUserRepository
+	upload *UploadUserUseCase
+}
+
+func NewStreamUploadUserUseCase(f StreamUserRepository, u UploadUserRepository, opts ...UseCaseOption) *StreamUploadUserUseCase {
+	return &StreamUploadUserUseCase{find: f, upload: NewUploadUserUseCase(u, opts...)}
+}
+
+// Run keeps going after a failed upload and returns all failures joined,
+// together with any error from reading.
+func (uc *StreamUploadUserUseCase) Run(ctx context.Context) error {
+	users, readErrs := uc.find.FindAllStream(ctx)
+	var errs []error
+	for u := range users {
+		if err := uc.upload.Run(ctx, uc.upload.opts.mapper.FromEntity(u)); err != nil {
+			errs = append(errs, fmt.Errorf("user id %d: %w", u.ID(), err))
+		}
+	}
+	if err := <-readErrs; err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// PipelineUploadUserUseCase reads users from a stream and uploads them with a
+// bounded pool of workers, so reading and uploading overlap.
+type PipelineUploadUserUseCase struct {
+	find    StreamUserRepository
+	upload  *UploadUserUseCase
+	workers int
+}
+
+func NewPipelineUploadUserUseCase(f StreamUserRepository, u UploadUserRepository, workers int, opts ...UseCaseOption) *PipelineUploadUserUseCase {
+	if workers < 1 {
+		workers = 1
+	}
+	return &PipelineUploadUserUseCase{find: f, upload: NewUploadUserUseCase(u, opts...), workers: workers}
+}
+
+// Run stops at the first failed upload or read error: the stream and the
+// remaining workers are cancelled and that error is returned. Run does not
+// return until the stream and every worker have finished.
+func (uc *PipelineUploadUserUseCase) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	users, readErrs := uc.find.FindAllStream(ctx)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for range uc.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range users {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := uc.upload.Run(ctx, uc.upload.opts.mapper.FromEntity(u)); err != nil {
+					fail(fmt.Errorf("user id %d: %w", u.ID(), err))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := <-readErrs; err != nil {
+		fail(err)
+	}
+	return firstErr
+}
+
+// SyncUsersUseCase uploads only users that are missing from the store or
+// whose stored content differs.
+type SyncUsersUseCase struct {
+	repo SyncUserRepository
+	opts useCaseOptions
+}
+
+func NewSyncUsersUseCase(r SyncUserRepository, opts ...UseCaseOption) *SyncUsersUseCase {
+	return &SyncUsersUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run returns the number of users that were uploaded. The stored hash is
+// only read for users whose key is already present.
+func (uc *SyncUsersUseCase) Run(ctx context.Context, dtos []*UserDTO) (int, error) {
+	listCtx, cancelList := uc.opts.operationContext(ctx)
+	defer cancelList()
+	keys, err := uc.repo.ListKeys(listCtx)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	cfg, err := config.LoadDefaultConfig(ctx)
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+	uploaded := 0
+	for _, dto := range dtos {
+		if err := uc.opts.checkDTO(dto); err != nil {
+			return uploaded, err
+		}
+		u, err := uc.opts.mapper.ToEntity(dto)
+		if err != nil {
+			return uploaded, err
+		}
+		key, hash, err := uc.repo.StoredAs(u)
+		if err != nil {
+			return uploaded, err
+		}
+		if stored[key] {
+			unchanged, err := uc.unchanged(ctx, key, hash)
+			if err != nil {
+				return uploaded, err
+			}
+			if unchanged {
+				continue
+			}
+		}
+		opCtx, cancel := uc.opts.operationContext(ctx)
+		err = uc.repo.Upload(opCtx, u)
+		cancel()
+		if err != nil {
+			return uploaded, err
+		}
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+func (uc *SyncUsersUseCase) unchanged(ctx context.Context, key string, hash string) (bool, error) {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	stored, err := uc.repo.StoredHash(opCtx, key)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	client := s3.NewFromConfig(cfg)
+	return stored == hash, nil
+}
 
-	pgRepo := NewPostgresFindUserRepository(db)
-	s3Repo := NewS3UploadUserRepository(client, "company", "app/user")
+// ReconcileResult compares the number of users in the database with the
+// number of objects in the upload store.
+type ReconcileResult struct {
+	DBCount    int
+	StoreCount int
+	// Diff is DBCount - StoreCount.
+	Diff int
+}
 
-	findAllUC := NewFindAllUserUseCase(pgRepo)
-	uploadUC := NewUploadUserUseCase(s3Repo)
+// ReconcileUseCase checks that every user row has one stored object.
+type ReconcileUseCase struct {
+	find   FindUserRepository
+	upload SyncUserRepository
+	opts   useCaseOptions
+}
 
-	dtos, err := findAllUC.Run(ctx)
+func NewReconcileUseCase(f FindUserRepository, u SyncUserRepository, opts ...UseCaseOption) *ReconcileUseCase {
+	return &ReconcileUseCase{find: f, upload: u, opts: newUseCaseOptions(opts)}
+}
+
+// Run counts every object under the upload prefix. A nonzero Diff is logged
+// but is not an error; the caller decides what to do with it.
+func (uc *ReconcileUseCase) Run(ctx context.Context) (*ReconcileResult, error) {
+	countCtx, cancelCount := uc.opts.operationContext(ctx)
+	defer cancelCount()
+	dbCount, err := uc.find.Count(countCtx)
+	if err != nil {
+		return nil, err
+	}
+	listCtx, cancelList := uc.opts.operationContext(ctx)
+	defer cancelList()
+	keys, err := uc.upload.ListKeys(listCtx)
+	if err != nil {
+		return nil, err
+	}
+	res := &ReconcileResult{DBCount: dbCount, StoreCount: len(keys), Diff: dbCount - len(keys)}
+	if res.Diff != 0 {
+		uc.opts.logger.WarnContext(ctx, "reconcile users mismatch",
+			slog.Int("db_count", res.DBCount), slog.Int("store_count", res.StoreCount), slog.Int("diff", res.Diff))
+	}
+	return res, nil
+}
+
+// BatchUploadError reports every user that failed in a batch upload, keyed by user id.
+type BatchUploadError struct {
+	Failures map[int]error
+}
+
+func (e *BatchUploadError) failedIDs() []int {
+	ids := make([]int, 0, len(e.Failures))
+	for id := range e.Failures {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (e *BatchUploadError) Error() string {
+	return fmt.Sprintf("upload failed for user ids %v", e.failedIDs())
+}
+
+func (e *BatchUploadError) Unwrap() []error {
+	var errs []error
+	for _, id := range e.failedIDs() {
+		errs = append(errs, e.Failures[id])
+	}
+	return errs
+}
+
+type BatchUploadUserUseCase struct {
+	upload      *UploadUserUseCase
+	concurrency int
+}
+
+func NewBatchUploadUserUseCase(r UploadUserRepository, concurrency int, opts ...UseCaseOption) *BatchUploadUserUseCase {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &BatchUploadUserUseCase{upload: NewUploadUserUseCase(r, opts...), concurrency: concurrency}
+}
+
+// Run uploads dtos with at most the configured number of uploads in flight.
+// A failing user does not stop the others; once ctx is done no new uploads
+// are started.
+func (uc *BatchUploadUserUseCase) Run(ctx context.Context, dtos []*UserDTO) error {
+	if uc.upload.opts.uniqueEmails {
+		if err := checkUniqueEmails(dtos); err != nil {
+			return err
+		}
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures = map[int]error{}
+		done     int
+		stopped  bool
+	)
+	sem := make(chan struct{}, uc.concurrency)
+	for _, dto := range dtos {
+		// select picks at random when both cases are ready, so check ctx
+		// before and after taking a slot to never start an upload after
+		// cancellation.
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
+		select {
+		case <-ctx.Done():
+			stopped = true
+		case sem <- struct{}{}:
+			if ctx.Err() != nil {
+				<-sem
+				stopped = true
+			}
+		}
+		if stopped {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := uc.upload.Run(ctx, dto)
+			if err != nil && ctx.Err() == nil {
+				opCtx, cancel := uc.upload.opts.operationContext(ctx)
+				recErr := uc.upload.opts.deadLetters.Record(opCtx, dto, err)
+				cancel()
+				if recErr != nil {
+					err = errors.Join(err, fmt.Errorf("dead letter: %w", recErr))
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures[dto.ID] = err
+			}
+			done++
+			if uc.upload.opts.progress != nil {
+				uc.upload.opts.progress(done, len(dtos))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var err error
+	if len(failures) > 0 {
+		err = &BatchUploadError{Failures: failures}
+	}
+	if stopped {
+		return errors.Join(ctx.Err(), err)
+	}
+	return err
+}
+
+// checkUniqueEmails fails with ErrDuplicateEmail listing every email used by
+// more than one dto. Emails are compared in their normalized form.
+func checkUniqueEmails(dtos []*UserDTO) error {
+	counts := make(map[string]int, len(dtos))
+	for _, dto := range dtos {
+		email := strings.ToLower(strings.TrimSpace(dto.Email))
+		if normalized, err := NewEmail(dto.Email); err == nil {
+			email = normalized.String()
+		}
+		counts[email]++
+	}
+	var duplicates []string
+	for email, n := range counts {
+		if n > 1 {
+			duplicates = append(duplicates, email)
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	sort.Strings(duplicates)
+	return fmt.Errorf("batch emails %s: %w", strings.Join(duplicates, ", "), ErrDuplicateEmail)
+}
+
+type CreateUserUseCase struct {
+	repo CreateUserRepository
+	opts useCaseOptions
+}
+
+func NewCreateUserUseCase(r CreateUserRepository, opts ...UseCaseOption) *CreateUserUseCase {
+	return &CreateUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run creates the user described by dto. A zero dto.ID lets the store assign one.
+// If the UserCreated event cannot be published the user stays created and
+// Run returns its dto together with the error.
+func (uc *CreateUserUseCase) Run(ctx context.Context, dto *UserDTO) (*UserDTO, error) {
+	if err := uc.opts.checkDTO(dto); err != nil {
+		return nil, err
+	}
+	var u *User
+	var err error
+	if dto.ID == 0 {
+		u, err = NewUnsavedUser(dto.Name, dto.Email, Status(dto.StatusCode))
+	} else {
+		u, err = uc.opts.mapper.ToEntity(dto)
+	}
+	if err != nil {
+		return nil, err
+	}
+	createCtx, cancelCreate := uc.opts.operationContext(ctx)
+	defer cancelCreate()
+	if err := uc.repo.Create(createCtx, u); err != nil {
+		return nil, err
+	}
+	publishCtx, cancelPublish := uc.opts.operationContext(ctx)
+	defer cancelPublish()
+	if err := uc.opts.publisher.Publish(publishCtx, UserCreated{UserID: u.ID(), Email: u.Email()}); err != nil {
+		return uc.opts.mapper.FromEntity(u), fmt.Errorf("publish user created: %w", err)
+	}
+	return uc.opts.mapper.FromEntity(u), nil
+}
+
+// UpsertUserUseCase creates a user or updates the one with the same email.
+type UpsertUserUseCase struct {
+	repo UpsertUserRepository
+	opts useCaseOptions
+}
+
+func NewUpsertUserUseCase(r UpsertUserRepository, opts ...UseCaseOption) *UpsertUserUseCase {
+	return &UpsertUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run stores dto and reports whether it was inserted rather than updated.
+// A UserCreated event is published only for inserts.
+func (uc *UpsertUserUseCase) Run(ctx context.Context, dto *UserDTO) (*UserDTO, bool, error) {
+	if err := uc.opts.checkDTO(dto); err != nil {
+		return nil, false, err
+	}
+	var u *User
+	var err error
+	if dto.ID == 0 {
+		u, err = NewUnsavedUser(dto.Name, dto.Email, Status(dto.StatusCode))
+	} else {
+		u, err = uc.opts.mapper.ToEntity(dto)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	upsertCtx, cancelUpsert := uc.opts.operationContext(ctx)
+	defer cancelUpsert()
+	inserted, err := uc.repo.Upsert(upsertCtx, u)
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted {
+		publishCtx, cancelPublish := uc.opts.operationContext(ctx)
+		defer cancelPublish()
+		if err := uc.opts.publisher.Publish(publishCtx, UserCreated{UserID: u.ID(), Email: u.Email()}); err != nil {
+			return uc.opts.mapper.FromEntity(u), inserted, fmt.Errorf("publish user created: %w", err)
+		}
+	}
+	return uc.opts.mapper.FromEntity(u), inserted, nil
+}
+
+type ImportUsersUseCase struct {
+	uow        UnitOfWork
+	createOpts []UseCaseOption
+}
+
+// NewImportUsersUseCase passes opts on to the CreateUserUseCase run for each user.
+func NewImportUsersUseCase(u UnitOfWork, opts ...UseCaseOption) *ImportUsersUseCase {
+	return &ImportUsersUseCase{uow: u, createOpts: opts}
+}
+
+// Run creates all dtos in a single transaction. If any of them fails, none
+// of them is stored.
+func (uc *ImportUsersUseCase) Run(ctx context.Context, dtos []*UserDTO) ([]*UserDTO, error) {
+	tx, err := uc.uow.BeginTx(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	create := NewCreateUserUseCase(tx, uc.createOpts...)
+	var result []*UserDTO
 	for _, dto := range dtos {
-		if err := uploadUC.Run(ctx, dto); err != nil {
-			panic(err)
+		created, err := create.Run(ctx, dto)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("user id %d: %w", dto.ID, err), tx.Rollback())
+		}
+		result = append(result, created)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type DeleteUserUseCase struct {
+	repo DeleteUserRepository
+	opts useCaseOptions
+}
+
+func NewDeleteUserUseCase(r DeleteUserRepository, opts ...UseCaseOption) *DeleteUserUseCase {
+	return &DeleteUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *DeleteUserUseCase) Run(ctx context.Context, id int) error {
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.repo.Delete(opCtx, id)
+}
+
+type DeleteByStatusUserUseCase struct {
+	repo DeleteUserRepository
+	opts useCaseOptions
+}
+
+func NewDeleteByStatusUserUseCase(r DeleteUserRepository, opts ...UseCaseOption) *DeleteByStatusUserUseCase {
+	return &DeleteByStatusUserUseCase{repo: r, opts: newUseCaseOptions(opts)}
+}
+
+// Run deletes every user with status and returns how many were deleted. An
+// unknown status is rejected before anything is deleted.
+func (uc *DeleteByStatusUserUseCase) Run(ctx context.Context, status int) (int, error) {
+	if !Status(status).Valid() {
+		return 0, fmt.Errorf("status code %d is not valid", status)
+	}
+	opCtx, cancel := uc.opts.operationContext(ctx)
+	defer cancel()
+	return uc.repo.DeleteByStatus(opCtx, Status(status))
+}
+
+type UpdateUserUseCase struct {
+	findRepo   FindUserRepository
+	updateRepo UpdateUserRepository
+	opts       useCaseOptions
+}
+
+func NewUpdateUserUseCase(f FindUserRepository, u UpdateUserRepository, opts ...UseCaseOption) *UpdateUserUseCase {
+	return &UpdateUserUseCase{findRepo: f, updateRepo: u, opts: newUseCaseOptions(opts)}
+}
+
+// Run updates the user identified by dto.ID. Zero-valued fields in dto keep
+// the stored value. dto is a patch rather than a whole user, so unlike the
+// other usecases Run takes a struct literal; the merged user is validated
+// before it is stored.
+func (uc *UpdateUserUseCase) Run(ctx context.Context, dto *UserDTO) (*UserDTO, error) {
+	findCtx, cancelFind := uc.opts.operationContext(ctx)
+	defer cancelFind()
+	current, err := uc.findRepo.FindByID(findCtx, dto.ID)
+	if err != nil {
+		return nil, err
+	}
+	merged := uc.opts.mapper.FromEntity(current)
+	if dto.Name != "" {
+		merged.Name = dto.Name
+	}
+	if dto.Email != "" {
+		merged.Email = dto.Email
+	}
+	if dto.StatusCode != 0 {
+		merged.StatusCode = dto.StatusCode
+	}
+	u, err := uc.opts.mapper.ToEntity(merged)
+	if err != nil {
+		return nil, err
+	}
+	updateCtx, cancelUpdate := uc.opts.operationContext(ctx)
+	defer cancelUpdate()
+	if err := uc.updateRepo.Update(updateCtx, u); err != nil {
+		return nil, err
+	}
+	return uc.opts.mapper.FromEntity(u), nil
+}
+
+// SuspendUserUseCase soft-deletes a user by marking it suspended.
+type SuspendUserUseCase struct {
+	findRepo   FindUserRepository
+	updateRepo UpdateUserRepository
+	opts       useCaseOptions
+}
+
+func NewSuspendUserUseCase(f FindUserRepository, u UpdateUserRepository, opts ...UseCaseOption) *SuspendUserUseCase {
+	return &SuspendUserUseCase{findRepo: f, updateRepo: u, opts: newUseCaseOptions(opts)}
+}
+
+func (uc *SuspendUserUseCase) Run(ctx context.Context, id int) (*UserDTO, error) {
+	findCtx, cancelFind := uc.opts.operationContext(ctx)
+	defer cancelFind()
+	u, err := uc.findRepo.FindByID(findCtx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.Suspend(); err != nil {
+		return nil, err
+	}
+	updateCtx, cancelUpdate := uc.opts.operationContext(ctx)
+	defer cancelUpdate()
+	if err := uc.updateRepo.Update(updateCtx, u); err != nil {
+		return nil, err
+	}
+	return uc.opts.mapper.FromEntity(u), nil
+}
+
+// config
+type Config struct {
+	DatabaseURL      string
+	S3Bucket         string
+	S3KeyPrefix      string
+	AWSRegion        string
+	S3EndpointURL    string
+	S3ForcePathStyle bool
+	// HTTPClient, when set, carries all AWS traffic, e.g. through a proxy with
+	// a custom CA bundle. It is not read from the environment.
+	HTTPClient *http.Client
+	// AppID is sent in the User-Agent of every AWS request so uploads from
+	// different jobs can be told apart in access logs and CloudTrail.
+	AppID string
+}
+
+// defaultAppID is the AppID used when S3_APP_ID is not set.
+const defaultAppID = "example-clean-architecture-go"
+
+// LoadConfig reads the configuration from the environment. DATABASE_URL and
+// S3_BUCKET are required; S3_KEY_PREFIX defaults to app/user and an empty
+// AWS_REGION leaves region resolution to the AWS SDK. S3_ENDPOINT_URL and
+// S3_FORCE_PATH_STYLE point the S3 client at e.g. MinIO or LocalStack.
+// S3_APP_ID defaults to example-clean-architecture-go.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		DatabaseURL:   os.Getenv("DATABASE_URL"),
+		S3Bucket:      os.Getenv("S3_BUCKET"),
+		S3KeyPrefix:   os.Getenv("S3_KEY_PREFIX"),
+		AWSRegion:     os.Getenv("AWS_REGION"),
+		S3EndpointURL: os.Getenv("S3_ENDPOINT_URL"),
+		AppID:         os.Getenv("S3_APP_ID"),
+	}
+	var errs []error
+	if cfg.DatabaseURL == "" {
+		errs = append(errs, errors.New("DATABASE_URL must be set"))
+	}
+	if cfg.S3Bucket == "" {
+		errs = append(errs, errors.New("S3_BUCKET must be set"))
+	}
+	if v := os.Getenv("S3_FORCE_PATH_STYLE"); v != "" {
+		forcePathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("S3_FORCE_PATH_STYLE must be a boolean: %w", err))
+		}
+		cfg.S3ForcePathStyle = forcePathStyle
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if cfg.S3KeyPrefix == "" {
+		cfg.S3KeyPrefix = "app/user"
+	}
+	if cfg.AppID == "" {
+		cfg.AppID = defaultAppID
+	}
+	return cfg, nil
+}
+
+// s3ClientOptions applies the custom endpoint and path-style addressing from
+// cfg. Without them the client uses the standard AWS resolution.
+func s3ClientOptions(cfg *Config) []func(*s3.Options) {
+	var opts []func(*s3.Options)
+	if cfg.S3EndpointURL != "" {
+		opts = append(opts, func(o *s3.Options) { o.BaseEndpoint = aws.String(cfg.S3EndpointURL) })
+	}
+	if cfg.S3ForcePathStyle {
+		opts = append(opts, func(o *s3.Options) { o.UsePathStyle = true })
+	}
+	return opts
+}
+
+// newS3Client builds the S3 client from appCfg. Without appCfg.HTTPClient the
+// SDK's default HTTP client is used, and without appCfg.AppID the User-Agent
+// carries no app id.
+func newS3Client(ctx context.Context, appCfg *Config) (*s3.Client, error) {
+	var awsOpts []func(*config.LoadOptions) error
+	if appCfg.AWSRegion != "" {
+		awsOpts = append(awsOpts, config.WithRegion(appCfg.AWSRegion))
+	}
+	if appCfg.HTTPClient != nil {
+		awsOpts = append(awsOpts, config.WithHTTPClient(appCfg.HTTPClient))
+	}
+	if appCfg.AppID != "" {
+		awsOpts = append(awsOpts, config.WithAppID(appCfg.AppID))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, awsOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+	return s3.NewFromConfig(cfg, s3ClientOptions(appCfg)...), nil
+}
+
+// App owns everything run wires together and the resources behind it.
+// Repositories that hold a resource open between calls, such as the SQL
+// repositories over their db, implement io.Closer and are closed by Close.
+// The S3 client and the file-based repositories hold nothing between calls.
+type App struct {
+	FindAllUC *FindAllUserUseCase
+	UploadUC  *UploadUserUseCase
+
+	closers []io.Closer
+}
+
+// NewApp connects to Postgres and S3 and builds the usecases. If it fails,
+// whatever was already opened is closed again.
+func NewApp(ctx context.Context, appCfg *Config, logger *slog.Logger) (*App, error) {
+	app := &App{}
+	db, err := sqlx.Connect("postgres", appCfg.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to postgres: %w", err)
+	}
+	pgRepo := NewPostgresFindUserRepository(db)
+	app.closers = append(app.closers, pgRepo.(io.Closer))
+	client, err := newS3Client(ctx, appCfg)
+	if err != nil {
+		return nil, errors.Join(err, app.Close())
+	}
+
+	// Any UploadUserRepository can be wired here, e.g. NewGCSUploadUserRepository.
+	s3Repo, err := NewS3UploadUserRepository(client, appCfg.S3Bucket, appCfg.S3KeyPrefix)
+	if err != nil {
+		return nil, errors.Join(err, app.Close())
+	}
+
+	app.FindAllUC = NewFindAllUserUseCase(pgRepo, WithLogger(logger))
+	app.UploadUC = NewUploadUserUseCase(s3Repo, WithLogger(logger))
+	return app, nil
+}
+
+// Close closes every resource in reverse order of opening and joins their errors.
+func (a *App) Close() error {
+	var errs []error
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if err := a.closers[i].Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	a.closers = nil
+	return errors.Join(errs...)
+}
+
+// main exports every user from Postgres to S3. On SIGINT or SIGTERM the
+// context is cancelled: the in-flight upload is aborted, no further user is
+// started, and the program exits with the cancellation error. Any failure is
+// printed to stderr and the exit code is 1.
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context) (err error) {
+	if _, ok := correlationIDFrom(ctx); !ok {
+		ctx = WithCorrelationID(ctx, newCorrelationID())
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	appCfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	app, err := NewApp(ctx, appCfg, logger)
+	if err != nil {
+		return fmt.Errorf("build app: %w", err)
+	}
+	defer func() { err = errors.Join(err, app.Close()) }()
+
+	return export(ctx, app.FindAllUC, app.UploadUC)
+}
+
+// export is the body of run once everything is wired, kept separate so it can
+// be driven with any repositories.
+func export(ctx context.Context, findAllUC *FindAllUserUseCase, uploadUC *UploadUserUseCase) error {
+	dtos, err := findAllUC.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("find users: %w", err)
+	}
+	if err := uploadUC.RunAll(ctx, dtos); err != nil {
+		return fmt.Errorf("upload users: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,3467 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.uber.org/goleak"
+)
+
+func mustNewUser(t testing.TB, id int, name string, email string, status Status) *User {
+	t.Helper()
+	u, err := NewUser(id, name, email, status)
+	if err != nil {
+		t.Fatalf("NewUser(%d, %q, %q, %d): %v", id, name, email, status, err)
+	}
+	return u
+}
+
+func TestUseCasesPassErrUserNotFoundThrough(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryFindUserRepository(mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive))
+
+	if _, err := NewFindByIDUserUseCase(repo).Run(ctx, 2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindByIDUserUseCase.Run(2) error = %v, want ErrUserNotFound", err)
+	}
+	if _, err := NewFindUserByEmailUseCase(repo).Run(ctx, "bob@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindUserByEmailUseCase.Run error = %v, want ErrUserNotFound", err)
+	}
+	if _, err := NewFindByIDUserUseCase(repo).Run(ctx, 1); err != nil {
+		t.Errorf("FindByIDUserUseCase.Run(1) error = %v, want nil", err)
+	}
+}
+
+func seedUsers(t testing.TB) []*User {
+	t.Helper()
+	return []*User{
+		mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive),
+		mustNewUser(t, 2, "Bob", "bob@example.com", StatusInactive),
+		mustNewUser(t, 3, "Carol", "carol@example.com", StatusActive),
+	}
+}
+
+func TestInMemoryFindUserRepositoryFindAll(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryFindUserRepository(seedUsers(t)...)
+
+	users, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("FindAll returned %d users, want 3", len(users))
+	}
+	if err := users[0].Suspend(); err != nil {
+		t.Fatalf("Suspend: %v", err)
+	}
+
+	again, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if got := again[0].StatusCode(); got != StatusActive {
+		t.Errorf("stored user status = %d after mutating the returned copy, want %d", got, StatusActive)
+	}
+
+	dtos, err := NewFindAllUserUseCase(repo).Run(ctx)
+	if err != nil {
+		t.Fatalf("FindAllUserUseCase.Run: %v", err)
+	}
+	if len(dtos) != 3 || dtos[2].Name != "Carol" {
+		t.Errorf("FindAllUserUseCase.Run = %+v, want the three seeded users", dtos)
+	}
+}
+
+func TestInMemoryUploadUserRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryUploadUserRepository()
+	uc := NewUploadUserUseCase(repo)
+
+	var wg sync.WaitGroup
+	for _, u := range seedUsers(t) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := uc.Run(ctx, userToDTO(u)); err != nil {
+				t.Errorf("Run(%d): %v", u.ID(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(repo.Uploaded()); got != 3 {
+		t.Fatalf("Uploaded() has %d users, want 3", got)
+	}
+
+	errUpload := errors.New("upload failed")
+	repo.Err = errUpload
+	if err := uc.Run(ctx, userToDTO(mustNewUser(t, 4, "Dave", "dave@example.com", StatusActive))); !errors.Is(err, errUpload) {
+		t.Errorf("Run error = %v, want %v", err, errUpload)
+	}
+	if got := len(repo.Uploaded()); got != 3 {
+		t.Errorf("Uploaded() has %d users after a failed upload, want 3", got)
+	}
+
+	// A malformed DTO never reaches Upload.
+	fresh := NewInMemoryUploadUserRepository()
+	if err := NewUploadUserUseCase(fresh).Run(ctx, &UserDTO{ID: 5, Name: "Eve", Email: "not-an-email", StatusCode: int(StatusActive)}); err == nil {
+		t.Error("Run with an invalid email returned nil error")
+	}
+	if got := fresh.Uploaded(); len(got) != 0 {
+		t.Errorf("Uploaded() = %+v after an invalid DTO, want empty", got)
+	}
+}
+
+func TestDeleteUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryDeleteUserRepository(seedUsers(t)...)
+	uc := NewDeleteUserUseCase(repo)
+
+	if err := uc.Run(ctx, 2); err != nil {
+		t.Fatalf("Run(2): %v", err)
+	}
+	if got := len(repo.Users()); got != 2 {
+		t.Errorf("%d users left after deleting one, want 2", got)
+	}
+	if err := uc.Run(ctx, 2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Run(2) again error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestDeleteByStatusUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryDeleteUserRepository(seedUsers(t)...)
+	uc := NewDeleteByStatusUserUseCase(repo)
+
+	n, err := uc.Run(ctx, int(StatusActive))
+	if err != nil {
+		t.Fatalf("Run(active): %v", err)
+	}
+	if n != 2 {
+		t.Errorf("deleted %d users, want 2", n)
+	}
+	if left := repo.Users(); len(left) != 1 || left[0].ID() != 2 {
+		t.Errorf("users left = %v, want only user 2", left)
+	}
+
+	n, err = uc.Run(ctx, int(StatusSuspended))
+	if err != nil || n != 0 {
+		t.Errorf("Run(suspended) = %d, %v, want 0, nil", n, err)
+	}
+	if _, err := uc.Run(ctx, 9999); err == nil {
+		t.Error("Run(9999) succeeded, want an invalid status error")
+	}
+	if got := len(repo.Users()); got != 1 {
+		t.Errorf("%d users left after an invalid status, want 1", got)
+	}
+}
+
+func TestStatusValid(t *testing.T) {
+	for _, tt := range []struct {
+		status Status
+		want   bool
+	}{
+		{0, false},
+		{StatusActive, true},
+		{StatusInactive, true},
+		{StatusSuspended, true},
+		{9999, false},
+	} {
+		if got := tt.status.Valid(); got != tt.want {
+			t.Errorf("Status(%d).Valid() = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestNewUserRejectsUnknownStatus(t *testing.T) {
+	if _, err := NewUser(1, "Alice", "alice@example.com", 9999); err == nil {
+		t.Error("NewUser with status 9999 succeeded, want an error")
+	}
+	u := mustNewUser(t, 1, "Alice", "alice@example.com", StatusSuspended)
+	if got := u.StatusCode(); got != StatusSuspended {
+		t.Errorf("StatusCode() = %d, want %d", got, StatusSuspended)
+	}
+}
+
+func TestNewEmail(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "  Foo@Example.COM ", want: "foo@example.com"},
+		{raw: "bob@example.com", want: "bob@example.com"},
+		{raw: "not-an-email", wantErr: true},
+		{raw: "Bob <bob@example.com>", wantErr: true},
+		{raw: "", wantErr: true},
+	} {
+		got, err := NewEmail(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewEmail(%q) = %q, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewEmail(%q): %v", tt.raw, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("NewEmail(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNewUserNormalizesEmail(t *testing.T) {
+	a := mustNewUser(t, 1, "Foo", "  Foo@Example.COM ", StatusActive)
+	b := mustNewUser(t, 1, "Foo", "foo@example.com", StatusActive)
+	if !a.Equal(b) {
+		t.Errorf("users with the same mailbox written differently differ: %q vs %q", a.Email(), b.Email())
+	}
+}
+
+func TestFindAfterUserUseCaseIteratesAllUsers(t *testing.T) {
+	ctx := context.Background()
+	uc := NewFindAfterUserUseCase(NewInMemoryFindUserRepository(seedUsers(t)...))
+
+	var ids []int
+	cursor, pages := 0, 0
+	for {
+		page, next, err := uc.Run(ctx, cursor, 2)
+		if err != nil {
+			t.Fatalf("Run(%d, 2): %v", cursor, err)
+		}
+		pages++
+		for _, dto := range page {
+			ids = append(ids, dto.ID)
+		}
+		if len(page) < 2 {
+			break
+		}
+		cursor = next
+	}
+	if pages != 2 || len(ids) != 3 || ids[0] != 1 || ids[2] != 3 {
+		t.Errorf("iterated ids %v in %d pages, want [1 2 3] in 2", ids, pages)
+	}
+	if _, _, err := uc.Run(ctx, 0, 0); err == nil {
+		t.Error("Run with limit 0 succeeded, want an error")
+	}
+}
+
+func dtosFor(t testing.TB, n int) []*UserDTO {
+	t.Helper()
+	dtos := make([]*UserDTO, 0, n)
+	for id := 1; id <= n; id++ {
+		dto, err := NewUserDTO(id, fmt.Sprintf("User %d", id), fmt.Sprintf("user%d@example.com", id), int(StatusActive))
+		if err != nil {
+			t.Fatalf("NewUserDTO(%d): %v", id, err)
+		}
+		dtos = append(dtos, dto)
+	}
+	return dtos
+}
+
+func TestBatchUploadUserUseCaseBoundsConcurrency(t *testing.T) {
+	errBoom := errors.New("boom")
+	var (
+		inFlight, peak atomic.Int32
+		mu             sync.Mutex
+		uploaded       []int
+	)
+	// The first uploads wait until 3 are in flight at once, so a batch that
+	// does not run them concurrently times out instead of passing.
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if n == 3 {
+			releaseOnce.Do(func() { close(release) })
+		}
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			return errors.New("3 uploads were never in flight at once")
+		}
+		if user.ID()%4 == 0 {
+			return errBoom
+		}
+		mu.Lock()
+		uploaded = append(uploaded, user.ID())
+		mu.Unlock()
+		return nil
+	}}
+
+	err := NewBatchUploadUserUseCase(repo, 3).Run(context.Background(), dtosFor(t, 10))
+	var batchErr *BatchUploadError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Run error = %v, want a *BatchUploadError", err)
+	}
+	if ids := batchErr.failedIDs(); len(ids) != 2 || ids[0] != 4 || ids[1] != 8 {
+		t.Errorf("failed ids = %v, want [4 8]", ids)
+	}
+	if !errors.Is(err, errBoom) {
+		t.Errorf("errors.Is(%v, errBoom) = false", err)
+	}
+	sort.Ints(uploaded)
+	if want := []int{1, 2, 3, 5, 6, 7, 9, 10}; fmt.Sprint(uploaded) != fmt.Sprint(want) {
+		t.Errorf("uploaded ids = %v, want %v", uploaded, want)
+	}
+	if p := peak.Load(); p != 3 {
+		t.Errorf("%d uploads ran at once, want exactly the bound of 3", p)
+	}
+}
+
+func TestUploadUserUseCaseRunAllContinuesPastFailures(t *testing.T) {
+	errBoom := errors.New("boom")
+	var uploaded []int
+	repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		if user.ID() == 2 {
+			return errBoom
+		}
+		uploaded = append(uploaded, user.ID())
+		return nil
+	}}
+
+	err := NewUploadUserUseCase(repo).RunAll(context.Background(), dtosFor(t, 3))
+	if !errors.Is(err, errBoom) {
+		t.Errorf("RunAll error = %v, want it to wrap errBoom", err)
+	}
+	if len(uploaded) != 2 || uploaded[0] != 1 || uploaded[1] != 3 {
+		t.Errorf("uploaded ids %v, want [1 3]", uploaded)
+	}
+}
+
+func TestFileUploadUserRepository(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "users")
+	repo := NewFileUploadUserRepository(dir)
+	want := mustNewUser(t, 7, "Alice", "alice@example.com", StatusActive)
+
+	if err := repo.Upload(context.Background(), want); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "user-7.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var got User
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("read back %v, want %v", got, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir holds %d entries, want only user-7.json", len(entries))
+	}
+}
+
+// fakeS3 is an in-memory bucket that records every PutObject input. When err
+// is set every call fails with it.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	puts    []*s3.PutObjectInput
+	err     error
+}
+
+type fakeS3Object struct {
+	body     []byte
+	metadata map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]fakeS3Object{}}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts = append(f.puts, in)
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.objects[aws.ToString(in.Key)] = fakeS3Object{body: body, metadata: in.Metadata}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	obj, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{Metadata: obj.metadata}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	obj, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(obj.body)), Metadata: obj.metadata}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(in.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) putCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.puts)
+}
+
+func (f *fakeS3) body(t testing.TB, key string) []byte {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	if !ok {
+		t.Fatalf("no object stored under %q", key)
+	}
+	return obj.body
+}
+
+func (f *fakeS3) lastPut(t testing.TB) *s3.PutObjectInput {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.puts) == 0 {
+		t.Fatal("no PutObject call recorded")
+	}
+	return f.puts[len(f.puts)-1]
+}
+
+func newS3Repo(t testing.TB, client S3PutObjectAPI, opts ...S3UploadOption) *S3UploadUserRepository {
+	t.Helper()
+	repo, err := NewS3UploadUserRepository(client, "bucket", "users", opts...)
+	if err != nil {
+		t.Fatalf("NewS3UploadUserRepository: %v", err)
+	}
+	return repo.(*S3UploadUserRepository)
+}
+
+func TestS3UploadWithGzip(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	want, err := marshalUserJSON(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeS3()
+	if err := newS3Repo(t, client, WithGzip()).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := aws.ToString(client.lastPut(t).ContentEncoding); got != "gzip" {
+		t.Errorf("ContentEncoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(client.body(t, "users/user-1.json.gz")))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decompressed body = %s, want %s", got, want)
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if enc := plain.lastPut(t).ContentEncoding; enc != nil {
+		t.Errorf("ContentEncoding = %q without WithGzip, want unset", *enc)
+	}
+	if got := plain.body(t, "users/user-1.json"); !bytes.Equal(got, want) {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestS3UploadWithSSEKMS(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+
+	client := newFakeS3()
+	if err := newS3Repo(t, client, WithSSEKMS("key-1")).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	in := client.lastPut(t)
+	if in.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(in.SSEKMSKeyId) != "key-1" {
+		t.Errorf("ServerSideEncryption = %q, SSEKMSKeyId = %q, want aws:kms and key-1", in.ServerSideEncryption, aws.ToString(in.SSEKMSKeyId))
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if in := plain.lastPut(t); in.ServerSideEncryption != "" || in.SSEKMSKeyId != nil {
+		t.Errorf("encryption set without WithSSEKMS: %q, %v", in.ServerSideEncryption, in.SSEKMSKeyId)
+	}
+}
+
+func TestS3UploadThroughPutObjectAPI(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 3, "Carol", "carol@example.com", StatusActive)
+	client := newFakeS3()
+	repo := newS3Repo(t, client)
+
+	if err := repo.Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	in := client.lastPut(t)
+	if aws.ToString(in.Bucket) != "bucket" || aws.ToString(in.Key) != "users/user-3.json" || aws.ToString(in.ContentType) != "application/json" {
+		t.Errorf("PutObject input bucket=%q key=%q content type=%q", aws.ToString(in.Bucket), aws.ToString(in.Key), aws.ToString(in.ContentType))
+	}
+
+	errPut := errors.New("put failed")
+	client.err = errPut
+	if err := repo.Upload(ctx, user); !errors.Is(err, errPut) {
+		t.Errorf("Upload error = %v, want %v", err, errPut)
+	}
+}
+
+// timeoutErr is a net.Error that reports a timeout, which the retry
+// decorators treat as transient.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestRetryUploadUserRepositoryRetriesTransientErrors(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+
+	calls := 0
+	flaky := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		calls++
+		if calls <= 2 {
+			return timeoutErr{}
+		}
+		return nil
+	}}
+	if err := NewRetryUploadUserRepository(flaky, 3, time.Millisecond).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload after two timeouts: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("made %d attempts, want 3", calls)
+	}
+
+	calls = 0
+	errDenied := errors.New("access denied")
+	denied := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		calls++
+		return errDenied
+	}}
+	if err := NewRetryUploadUserRepository(denied, 3, time.Millisecond).Upload(ctx, user); !errors.Is(err, errDenied) {
+		t.Errorf("Upload error = %v, want %v", err, errDenied)
+	}
+	if calls != 1 {
+		t.Errorf("made %d attempts for a non-retryable error, want 1", calls)
+	}
+}
+
+func TestRetryUploadUserRepositoryKeepsLastErrorOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	flaky := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		cancel()
+		return timeoutErr{}
+	}}
+
+	err := NewRetryUploadUserRepository(flaky, 3, time.Hour).Upload(ctx, user)
+	if !errors.Is(err, context.Canceled) || !errors.As(err, new(timeoutErr)) {
+		t.Errorf("Upload error = %v, want both the cancellation and the last timeout", err)
+	}
+}
+
+func TestBackoffDelayIsCapped(t *testing.T) {
+	for _, attempt := range []int{1, 10, 63, 64, 1000} {
+		d := backoffDelay(time.Second, attempt)
+		if d <= 0 || d > maxBackoffDelay {
+			t.Errorf("backoffDelay(1s, %d) = %v, want within (0, %v]", attempt, d, maxBackoffDelay)
+		}
+	}
+	if d := backoffDelay(time.Duration(math.MaxInt64), 2); d <= 0 || d > maxBackoffDelay {
+		t.Errorf("backoffDelay(max, 2) = %v, want within (0, %v]", d, maxBackoffDelay)
+	}
+}
+
+// captureLogger returns a logger writing JSON records into the returned
+// function's result, one decoded map per record.
+func captureLogger(t testing.TB) (*slog.Logger, func() []map[string]any) {
+	t.Helper()
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	})
+	records := func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		var out []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("decode log line %q: %v", line, err)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+	return slog.New(slog.NewJSONHandler(w, nil)), records
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestUploadUserUseCaseLogsFailures(t *testing.T) {
+	logger, records := captureLogger(t)
+	repo := NewInMemoryUploadUserRepository()
+	repo.Err = errors.New("upload failed")
+
+	if err := NewUploadUserUseCase(repo, WithLogger(logger)).Run(context.Background(), dtosFor(t, 1)[0]); err == nil {
+		t.Fatal("Run succeeded, want the upload error")
+	}
+	var found bool
+	for _, rec := range records() {
+		if rec["level"] == "ERROR" && rec["msg"] == "upload user failed" {
+			found = true
+			if rec["user_id"] != float64(1) || rec["error"] != "upload failed" {
+				t.Errorf("error record = %v, want user_id 1 and the upload error", rec)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no error record in %v", records())
+	}
+}
+
+func TestUseCasesLogNothingByDefault(t *testing.T) {
+	if newUseCaseOptions(nil).logger.Enabled(context.Background(), slog.LevelError) {
+		t.Error("default logger is enabled, want a discarding logger")
+	}
+	if newUseCaseOptions([]UseCaseOption{WithLogger(nil)}).logger.Enabled(context.Background(), slog.LevelError) {
+		t.Error("WithLogger(nil) logger is enabled, want the default discarding logger")
+	}
+}
+
+// blockingFindRepo blocks FindByID and Count until ctx is done.
+type blockingFindRepo struct{ FindUserRepository }
+
+func (blockingFindRepo) FindByID(ctx context.Context, id int) (*User, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingFindRepo) Count(ctx context.Context) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// blockingIdempotencyStore blocks Seen until ctx is done.
+type blockingIdempotencyStore struct{ AlwaysProcessIdempotencyStore }
+
+func (blockingIdempotencyStore) Seen(ctx context.Context, key string) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestWithTimeoutBoundsRepositoryCalls(t *testing.T) {
+	ctx := context.Background()
+	timeout := WithTimeout(10 * time.Millisecond)
+	slow := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	dto := dtosFor(t, 1)[0]
+
+	for name, run := range map[string]func() error{
+		"upload": func() error { return NewUploadUserUseCase(slow, timeout).Run(ctx, dto) },
+		"idempotency seen": func() error {
+			return NewUploadUserUseCase(NewInMemoryUploadUserRepository(), timeout, WithIdempotencyStore(blockingIdempotencyStore{})).Run(ctx, dto)
+		},
+		"find by id": func() error {
+			_, err := NewFindByIDUserUseCase(blockingFindRepo{}, timeout).Run(ctx, 1)
+			return err
+		},
+		"count": func() error {
+			_, err := NewCountUserUseCase(blockingFindRepo{}, timeout).Run(ctx)
+			return err
+		},
+		"update": func() error {
+			_, err := NewUpdateUserUseCase(blockingFindRepo{}, nil, timeout).Run(ctx, dto)
+			return err
+		},
+	} {
+		done := make(chan error, 1)
+		go func() { done <- run() }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%s: error = %v, want context.DeadlineExceeded", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: still blocked after 1s, want the 10ms timeout", name)
+		}
+	}
+}
+
+func TestMetricsUploadUserRepository(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	metrics, err := NewUploadMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewUploadMetrics: %v", err)
+	}
+	inner := NewInMemoryUploadUserRepository()
+	repo := NewMetricsUploadUserRepository(inner, metrics)
+	users := seedUsers(t)
+
+	for _, u := range users[:2] {
+		if err := repo.Upload(ctx, u); err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+	}
+	inner.Err = errors.New("upload failed")
+	if err := repo.Upload(ctx, users[2]); err == nil {
+		t.Fatal("Upload succeeded, want the injected error")
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	counts := map[string]float64{}
+	var observed uint64
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch f.GetName() {
+			case "user_uploads_total":
+				counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+			case "user_upload_duration_seconds":
+				observed = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if counts["success"] != 2 || counts["failure"] != 1 {
+		t.Errorf("user_uploads_total = %v, want success 2 and failure 1", counts)
+	}
+	if observed != 3 {
+		t.Errorf("user_upload_duration_seconds has %d samples, want 3", observed)
+	}
+}
+
+// newSQLiteUserDB returns an in-memory database with an app.user table.
+// SQLite accepts the $n placeholders and RETURNING used by the Postgres
+// repositories, so they can be tested against it.
+func newSQLiteUserDB(t testing.TB) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Every connection gets its own :memory: database.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`ATTACH DATABASE ':memory:' AS app`,
+		`CREATE TABLE app.user (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			email TEXT NOT NULL UNIQUE,
+			status_code INTEGER NOT NULL,
+			updated_at TIMESTAMP
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func countRows(t testing.TB, db *sqlx.DB) int {
+	t.Helper()
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM app.user`); err != nil {
+		t.Fatalf("count rows: %v", err)
+	}
+	return n
+}
+
+func TestImportUsersUseCaseRollsBackOnFailure(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	uc := NewImportUsersUseCase(NewPostgresUnitOfWork(db))
+
+	dtos := dtosFor(t, 3)
+	dtos[2].Email = dtos[0].Email
+	if _, err := uc.Run(ctx, dtos); err == nil {
+		t.Fatal("Run succeeded with a duplicate email in the third user, want an error")
+	}
+	if n := countRows(t, db); n != 0 {
+		t.Errorf("%d rows committed after a failed import, want 0", n)
+	}
+
+	created, err := uc.Run(ctx, dtosFor(t, 3))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(created) != 3 || countRows(t, db) != 3 {
+		t.Errorf("created %d users and %d rows, want 3 of each", len(created), countRows(t, db))
+	}
+}
+
+func TestCSVExportUserRepository(t *testing.T) {
+	users := seedUsers(t)
+	users[1] = mustNewUser(t, 2, "Bob, Jr.", "bob@example.com", StatusInactive)
+
+	var buf bytes.Buffer
+	if err := NewExportUsersUseCase(NewCSVExportUserRepository(&buf)).Run(context.Background(), []*UserDTO{userToDTO(users[0]), userToDTO(users[1]), userToDTO(users[2])}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	want := [][]string{
+		{"id", "name", "email", "status_code"},
+		{"1", "Alice", "alice@example.com", "1"},
+		{"2", "Bob, Jr.", "bob@example.com", "2"},
+		{"3", "Carol", "carol@example.com", "1"},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
+
+func decodeNDJSON(t testing.TB, data []byte) []S3User {
+	t.Helper()
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		t.Fatalf("NDJSON %q does not end with a newline", data)
+	}
+	var users []S3User
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		var u S3User
+		if err := json.Unmarshal(line, &u); err != nil {
+			t.Fatalf("decode line %q: %v", line, err)
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+func TestNDJSONExports(t *testing.T) {
+	ctx := context.Background()
+	users := seedUsers(t)
+	check := func(name string, data []byte) {
+		t.Helper()
+		got := decodeNDJSON(t, data)
+		if len(got) != len(users) {
+			t.Fatalf("%s: %d lines, want %d", name, len(got), len(users))
+		}
+		for i, u := range users {
+			if got[i] != toS3User(u) {
+				t.Errorf("%s: line %d = %+v, want %+v", name, i, got[i], toS3User(u))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := NewNDJSONExportUserRepository(&buf).Export(ctx, users); err != nil {
+		t.Fatalf("writer Export: %v", err)
+	}
+	check("writer", buf.Bytes())
+
+	path := filepath.Join(t.TempDir(), "users.ndjson")
+	if err := NewNDJSONFileExportUserRepository(path).Export(ctx, users); err != nil {
+		t.Fatalf("file Export: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("file", data)
+
+	client := newFakeS3()
+	if err := NewS3NDJSONExportUserRepository(client, "bucket", "users").Export(ctx, users); err != nil {
+		t.Fatalf("S3 Export: %v", err)
+	}
+	check("s3", client.body(t, "users/users.ndjson"))
+}
+
+func TestS3UploadWithKeyTemplate(t *testing.T) {
+	user := mustNewUser(t, 5, "Eve", "eve@example.com", StatusActive)
+	client := newFakeS3()
+	if err := newS3Repo(t, client, WithKeyTemplate(`archive/{{.ID}}/user.json`)).Upload(context.Background(), user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := aws.ToString(client.lastPut(t).Key); got != "archive/5/user.json" {
+		t.Errorf("key = %q, want archive/5/user.json", got)
+	}
+
+	for _, tmpl := range []string{`{{.ID`, `{{.Missing}}`} {
+		if _, err := NewS3UploadUserRepository(client, "bucket", "users", WithKeyTemplate(tmpl)); err == nil {
+			t.Errorf("WithKeyTemplate(%q) succeeded, want an error", tmpl)
+		}
+	}
+}
+
+// testClock is a Clock that only moves when Advance is called.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock(now time.Time) *testClock { return &testClock{now: now} }
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestS3UploadWithClockGivesPredictableDatedKeys(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	client := newFakeS3()
+	repo := newS3Repo(t, client, WithClock(clock), WithKeyTemplate(`users/{{.Now.Format "2006/01/02"}}/user-{{.ID}}.json`))
+
+	if err := repo.Upload(context.Background(), mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := aws.ToString(client.lastPut(t).Key); got != "users/2024/01/02/user-1.json" {
+		t.Errorf("key = %q, want users/2024/01/02/user-1.json", got)
+	}
+}
+
+func TestSQLiteFindUserRepositoryFindAll(t *testing.T) {
+	db, err := sqlx.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT NOT NULL, email TEXT NOT NULL, status_code INTEGER NOT NULL)`,
+		`INSERT INTO user VALUES (1, '  Alice  ', 'Alice@Example.COM', 1), (2, 'Bob', 'bob@example.com', 2)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	users, err := NewSQLiteFindUserRepository(db).FindAll(context.Background())
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	want := []*User{
+		mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive),
+		mustNewUser(t, 2, "Bob", "bob@example.com", StatusInactive),
+	}
+	if len(users) != len(want) {
+		t.Fatalf("FindAll returned %d users, want %d", len(users), len(want))
+	}
+	for i := range want {
+		if !users[i].Equal(want[i]) {
+			t.Errorf("user %d = %v, want %v", i, users[i], want[i])
+		}
+	}
+}
+
+// gatedFindRepo counts FindByID calls and holds each one until release is
+// closed, signalling started when the first call arrives.
+type gatedFindRepo struct {
+	FindUserRepository
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newGatedFindRepo(t testing.TB) *gatedFindRepo {
+	return &gatedFindRepo{
+		FindUserRepository: NewInMemoryFindUserRepository(seedUsers(t)...),
+		started:            make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+}
+
+func (r *gatedFindRepo) FindByID(ctx context.Context, id int) (*User, error) {
+	r.calls.Add(1)
+	r.once.Do(func() { close(r.started) })
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return r.FindUserRepository.FindByID(ctx, id)
+}
+
+func TestCachingFindUserRepositoryCollapsesConcurrentMisses(t *testing.T) {
+	repo := newGatedFindRepo(t)
+	cache := NewCachingFindUserRepository(repo, 10, time.Minute, nil)
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	go func() {
+		_, err := cache.FindByID(firstCtx, 1)
+		results <- err
+	}()
+	<-repo.started
+	go func() {
+		u, err := cache.FindByID(context.Background(), 1)
+		if err == nil && u.ID() != 1 {
+			err = fmt.Errorf("got user %d, want 1", u.ID())
+		}
+		results <- err
+	}()
+	// Give the second caller time to join the in-flight lookup, then drop
+	// the first caller; the shared lookup must carry on for the second.
+	time.Sleep(20 * time.Millisecond)
+	cancelFirst()
+	if err := <-results; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller error = %v, want context.Canceled", err)
+	}
+	close(repo.release)
+	if err := <-results; err != nil {
+		t.Errorf("second caller: %v", err)
+	}
+	if n := repo.calls.Load(); n != 1 {
+		t.Errorf("underlying FindByID called %d times, want 1", n)
+	}
+}
+
+func TestCachingFindUserRepositoryExpiresByClock(t *testing.T) {
+	ctx := context.Background()
+	repo := newGatedFindRepo(t)
+	close(repo.release)
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewCachingFindUserRepository(repo, 10, time.Minute, clock)
+
+	for _, step := range []struct {
+		advance time.Duration
+		calls   int32
+	}{
+		{0, 1},
+		{59 * time.Second, 1},
+		{2 * time.Second, 2},
+	} {
+		clock.Advance(step.advance)
+		if _, err := cache.FindByID(ctx, 1); err != nil {
+			t.Fatalf("FindByID: %v", err)
+		}
+		if n := repo.calls.Load(); n != step.calls {
+			t.Errorf("after advancing %v: %d lookups, want %d", step.advance, n, step.calls)
+		}
+	}
+
+	cache.Invalidate(1)
+	if _, err := cache.FindByID(ctx, 1); err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if n := repo.calls.Load(); n != 3 {
+		t.Errorf("after Invalidate: %d lookups, want 3", n)
+	}
+}
+
+func TestCachingFindUserRepositoryInvalidateDuringLookup(t *testing.T) {
+	ctx := context.Background()
+
+	// A lookup that started before Invalidate must not repopulate the cache.
+	repo := newGatedFindRepo(t)
+	cache := NewCachingFindUserRepository(repo, 10, time.Minute, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.FindByID(ctx, 1)
+		done <- err
+	}()
+	<-repo.started
+	cache.Invalidate(1)
+	close(repo.release)
+	if err := <-done; err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if _, err := cache.FindByID(ctx, 1); err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if n := repo.calls.Load(); n != 2 {
+		t.Errorf("underlying FindByID called %d times, want 2", n)
+	}
+
+	// A caller arriving after Invalidate must not join the stale lookup.
+	repo = newGatedFindRepo(t)
+	cache = NewCachingFindUserRepository(repo, 10, time.Minute, nil)
+	results := make(chan error, 2)
+	lookup := func() {
+		_, err := cache.FindByID(ctx, 1)
+		results <- err
+	}
+	go lookup()
+	<-repo.started
+	cache.Invalidate(1)
+	go lookup()
+	deadline := time.Now().Add(5 * time.Second)
+	for repo.calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the caller after Invalidate never started its own lookup")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(repo.release)
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Errorf("FindByID: %v", err)
+		}
+	}
+}
+
+func TestNewPostgresTable(t *testing.T) {
+	for _, tt := range []struct {
+		schema, table string
+		wantErr       bool
+	}{
+		{"crm", "members", false},
+		{"app", "user_v2", false},
+		{"crm", "members; DROP TABLE app.user", true},
+		{"crm.x", "members", true},
+		{"", "members", true},
+		{"crm", `"members"`, true},
+	} {
+		got, err := NewPostgresTable(tt.schema, tt.table)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewPostgresTable(%q, %q) error = %v, want error %v", tt.schema, tt.table, err, tt.wantErr)
+		}
+		if err == nil && got.name != tt.schema+"."+tt.table {
+			t.Errorf("NewPostgresTable(%q, %q) = %q", tt.schema, tt.table, got.name)
+		}
+	}
+}
+
+func TestPostgresFindUserRepositoryWithCustomTable(t *testing.T) {
+	db := newSQLiteUserDB(t)
+	for _, stmt := range []string{
+		`ATTACH DATABASE ':memory:' AS crm`,
+		`CREATE TABLE crm.members (id INTEGER PRIMARY KEY, name TEXT, email TEXT, status_code INTEGER)`,
+		`INSERT INTO crm.members VALUES (9, 'Ivy', 'ivy@example.com', 1)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	table, err := NewPostgresTable("crm", "members")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewPostgresFindUserRepository(db, WithPostgresTable(table))
+	if got := repo.(*PostgresFindUserRepository).table; got != "crm.members" {
+		t.Errorf("table = %q, want crm.members", got)
+	}
+	users, err := repo.FindAll(context.Background())
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if len(users) != 1 || users[0].ID() != 9 {
+		t.Errorf("FindAll = %v, want only the crm.members row", users)
+	}
+	if got := NewPostgresFindUserRepository(db).(*PostgresFindUserRepository).table; got != "app.user" {
+		t.Errorf("default table = %q, want app.user", got)
+	}
+}
+
+func TestNewUserEmailRules(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		email   string
+		wantErr bool
+	}{
+		{"plain", "alice@example.com", false},
+		{"plus tag", "alice+tag@example.co.uk", false},
+		{"254 chars", strings.Repeat("a", 242) + "@example.com", false},
+		{"255 chars", strings.Repeat("a", 243) + "@example.com", true},
+		{"display name", "Alice <alice@example.com>", true},
+		{"quoted display name", `"Alice" <alice@example.com>`, true},
+		{"quoted @ in local part", `"a@b"@example.com`, true},
+		{"no @", "alice.example.com", true},
+	} {
+		_, err := NewUser(1, "Alice", tt.email, StatusActive)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: NewUser(%q) error = %v, want error %v", tt.name, tt.email, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUserJSONRoundTrip(t *testing.T) {
+	want := mustNewUser(t, 1, "Alice", "alice@example.com", StatusSuspended)
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var shape S3User
+	if err := json.Unmarshal(data, &shape); err != nil {
+		t.Fatal(err)
+	}
+	if shape != toS3User(want) {
+		t.Errorf("Marshal wrote %+v, want the S3User shape %+v", shape, toS3User(want))
+	}
+	var got User
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("round trip = %v, want %v", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"id":1,"name":"Alice","email":"not-an-email","status_code":1}`), &got); err == nil {
+		t.Error("Unmarshal accepted an invalid email")
+	}
+}
+
+func TestUserEqual(t *testing.T) {
+	base := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	var nilUser *User
+	for _, tt := range []struct {
+		name  string
+		other *User
+		want  bool
+	}{
+		{"same values", mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive), true},
+		{"different id", mustNewUser(t, 2, "Alice", "alice@example.com", StatusActive), false},
+		{"different name", mustNewUser(t, 1, "Alicia", "alice@example.com", StatusActive), false},
+		{"different email", mustNewUser(t, 1, "Alice", "alicia@example.com", StatusActive), false},
+		{"different status", mustNewUser(t, 1, "Alice", "alice@example.com", StatusInactive), false},
+		{"nil other", nil, false},
+	} {
+		if got := base.Equal(tt.other); got != tt.want {
+			t.Errorf("%s: Equal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !nilUser.Equal(nil) {
+		t.Error("nil.Equal(nil) = false, want true")
+	}
+	if nilUser.Equal(base) {
+		t.Error("nil.Equal(user) = true, want false")
+	}
+}
+
+func TestUserStringMasksEmail(t *testing.T) {
+	for _, tt := range []struct {
+		user *User
+		want string
+	}{
+		{mustNewUser(t, 1, "Jane", "jane.doe@example.com", StatusActive), "User(id=1, name=Jane, email=j***@example.com)"},
+		{mustNewUser(t, 2, "J", "j@example.com", StatusActive), "User(id=2, name=J, email=j***@example.com)"},
+		{NewUserUnchecked(3, "Nobody", "", StatusActive), "User(id=3, name=Nobody, email=)"},
+	} {
+		if got := tt.user.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSyncUsersUseCaseUploadsOnlyChanges(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3()
+	// SSE-KMS makes S3 report an ETag that is not the MD5 of the body, which
+	// must not make unchanged users look changed.
+	repo := newS3Repo(t, client, WithSSEKMS("key-1"))
+	users := seedUsers(t)
+	for _, u := range users[:2] {
+		if err := repo.Upload(ctx, u); err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+	}
+	before := client.putCount()
+
+	changed := userToDTO(users[1])
+	changed.Name = "Robert"
+	n, err := NewSyncUsersUseCase(repo).Run(ctx, []*UserDTO{userToDTO(users[0]), changed, userToDTO(users[2])})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n != 2 || client.putCount()-before != 2 {
+		t.Errorf("uploaded %d users with %d puts, want 2 of each", n, client.putCount()-before)
+	}
+	var got S3User
+	if err := json.Unmarshal(client.body(t, "users/user-2.json"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Robert" {
+		t.Errorf("stored name = %q, want the changed name Robert", got.Name)
+	}
+
+	n, err = NewSyncUsersUseCase(repo).Run(ctx, []*UserDTO{userToDTO(users[0]), changed, userToDTO(users[2])})
+	if err != nil || n != 0 {
+		t.Errorf("second Run = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestS3UploadExistsAndSkipExisting(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3()
+	repo := newS3Repo(t, client)
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+
+	if ok, err := repo.Exists(ctx, 1); ok || err != nil {
+		t.Errorf("Exists before upload = %v, %v, want false, nil", ok, err)
+	}
+	if err := repo.Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if ok, err := repo.Exists(ctx, 1); !ok || err != nil {
+		t.Errorf("Exists after upload = %v, %v, want true, nil", ok, err)
+	}
+
+	before := client.putCount()
+	if err := NewUploadUserUseCase(repo, WithSkipExisting()).Run(ctx, userToDTO(user)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if client.putCount() != before {
+		t.Error("WithSkipExisting uploaded a user that is already stored")
+	}
+
+	client.err = errors.New("head failed")
+	if _, err := repo.Exists(ctx, 1); err == nil {
+		t.Error("Exists swallowed a HeadObject error other than NotFound")
+	}
+}
+
+func TestUserDTOValidate(t *testing.T) {
+	valid := UserDTO{ID: 1, Name: "Alice", Email: "alice@example.com", StatusCode: int(StatusActive)}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate(%+v): %v", valid, err)
+	}
+	for name, mutate := range map[string]func(*UserDTO){
+		"id":     func(d *UserDTO) { d.ID = 0 },
+		"name":   func(d *UserDTO) { d.Name = "   " },
+		"email":  func(d *UserDTO) { d.Email = "alice" },
+		"status": func(d *UserDTO) { d.StatusCode = 9999 },
+	} {
+		dto := valid
+		mutate(&dto)
+		if err := dto.Validate(); err == nil {
+			t.Errorf("invalid %s: Validate(%+v) = nil, want an error", name, dto)
+		}
+		if _, err := dtoToUser(&dto); err == nil {
+			t.Errorf("invalid %s: dtoToUser(%+v) succeeded", name, dto)
+		}
+	}
+}
+
+func TestNewUserDTO(t *testing.T) {
+	dto, err := NewUserDTO(1, " Alice ", "Alice@Example.com", int(StatusActive))
+	if err != nil {
+		t.Fatalf("NewUserDTO: %v", err)
+	}
+	if want := (UserDTO{ID: 1, Name: "Alice", Email: "alice@example.com", StatusCode: 1, validated: true}); *dto != want {
+		t.Errorf("NewUserDTO = %+v, want %+v", *dto, want)
+	}
+	if dto, err := NewUnsavedUserDTO("Alice", "alice@example.com", int(StatusActive)); err != nil || dto.ID != 0 {
+		t.Errorf("NewUnsavedUserDTO = %+v, %v, want a dto without an id", dto, err)
+	}
+	if _, err := NewUnsavedUserDTO("Alice", "alice", int(StatusActive)); err == nil {
+		t.Error("NewUnsavedUserDTO with an invalid email succeeded")
+	}
+
+	// A literal is rejected even when its fields are valid, unless the
+	// usecase was built to trust its DTOs.
+	literal := UserDTO{ID: 1, Name: "Alice", Email: "alice@example.com", StatusCode: 1}
+	repo := NewInMemoryUploadUserRepository()
+	if err := NewUploadUserUseCase(repo).Run(context.Background(), &literal); !errors.Is(err, ErrUnvalidatedDTO) || len(repo.Uploaded()) != 0 {
+		t.Errorf("Run(literal) error = %v, want ErrUnvalidatedDTO and no upload", err)
+	}
+	if err := NewUploadUserUseCase(repo, WithUncheckedUsers()).Run(context.Background(), &literal); err != nil {
+		t.Errorf("Run(literal) with WithUncheckedUsers: %v", err)
+	}
+	for _, in := range []UserDTO{
+		{ID: 0, Name: "Alice", Email: "alice@example.com", StatusCode: 1},
+		{ID: 1, Name: "", Email: "alice@example.com", StatusCode: 1},
+		{ID: 1, Name: "Alice", Email: "alice", StatusCode: 1},
+		{ID: 1, Name: "Alice", Email: "alice@example.com", StatusCode: 0},
+	} {
+		dto, err := NewUserDTO(in.ID, in.Name, in.Email, in.StatusCode)
+		if err == nil || dto != nil {
+			t.Errorf("NewUserDTO(%+v) = %+v, %v, want nil and an error", in, dto, err)
+		}
+		repo := NewInMemoryUploadUserRepository()
+		if err := NewUploadUserUseCase(repo).Run(context.Background(), &in); err == nil || len(repo.Uploaded()) != 0 {
+			t.Errorf("UploadUserUseCase accepted the invalid literal %+v", in)
+		}
+	}
+}
+
+func TestFindByStatusUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	uc := NewFindByStatusUserUseCase(NewInMemoryFindUserRepository(seedUsers(t)...))
+
+	active, err := uc.Run(ctx, int(StatusActive))
+	if err != nil {
+		t.Fatalf("Run(active): %v", err)
+	}
+	if len(active) != 2 || active[0].ID != 1 || active[1].ID != 3 {
+		t.Errorf("active users = %+v, want ids 1 and 3", active)
+	}
+	suspended, err := uc.Run(ctx, int(StatusSuspended))
+	if err != nil || len(suspended) != 0 {
+		t.Errorf("Run(suspended) = %+v, %v, want none", suspended, err)
+	}
+	if _, err := uc.Run(ctx, 9999); err == nil {
+		t.Error("Run(9999) succeeded, want an invalid status error")
+	}
+}
+
+func TestFindAllUserUseCaseRunSorted(t *testing.T) {
+	ctx := context.Background()
+	uc := NewFindAllUserUseCase(NewInMemoryFindUserRepository(
+		mustNewUser(t, 1, "Carol", "carol@example.com", StatusActive),
+		mustNewUser(t, 2, "Alice", "alice@example.com", StatusActive),
+		mustNewUser(t, 3, "Bob", "bob@example.com", StatusActive),
+	))
+
+	for _, tt := range []struct {
+		sortBy string
+		desc   bool
+		want   []int
+	}{
+		{"id", false, []int{1, 2, 3}},
+		{"id", true, []int{3, 2, 1}},
+		{"name", false, []int{2, 3, 1}},
+		{"email", true, []int{1, 3, 2}},
+	} {
+		dtos, err := uc.RunSorted(ctx, tt.sortBy, tt.desc)
+		if err != nil {
+			t.Fatalf("RunSorted(%q, %v): %v", tt.sortBy, tt.desc, err)
+		}
+		var ids []int
+		for _, dto := range dtos {
+			ids = append(ids, dto.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("RunSorted(%q, %v) ids = %v, want %v", tt.sortBy, tt.desc, ids, tt.want)
+		}
+	}
+
+	for _, field := range []string{"status_code", "id; DROP TABLE app.user", ""} {
+		if _, err := NewUserOrder(field, false); err == nil {
+			t.Errorf("NewUserOrder(%q) succeeded, want it rejected", field)
+		}
+	}
+}
+
+func TestUploadUserUseCaseDryRun(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3()
+	logger, records := captureLogger(t)
+	uc := NewUploadUserUseCase(newS3Repo(t, client), WithDryRun(), WithLogger(logger))
+
+	if err := uc.Run(ctx, dtosFor(t, 1)[0]); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n := client.putCount(); n != 0 {
+		t.Errorf("dry run made %d PutObject calls, want 0", n)
+	}
+	var logged bool
+	for _, rec := range records() {
+		if rec["msg"] == "upload user dry run" && rec["key"] == "users/user-1.json" && rec["size"].(float64) > 0 {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("no dry run record with key and size in %v", records())
+	}
+	if err := uc.Run(ctx, &UserDTO{ID: 1, Name: "Alice", Email: "alice", StatusCode: 1}); err == nil {
+		t.Error("dry run accepted an invalid DTO")
+	}
+}
+
+func insertUsers(t testing.TB, db *sqlx.DB, users ...*User) {
+	t.Helper()
+	for _, u := range users {
+		if _, err := db.Exec(`INSERT INTO app.user (id, name, email, status_code) VALUES ($1, $2, $3, $4)`, u.ID(), u.Name(), u.Email(), int(u.StatusCode())); err != nil {
+			t.Fatalf("insert user %d: %v", u.ID(), err)
+		}
+	}
+}
+
+func TestFindAllStream(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	insertUsers(t, db, seedUsers(t)...)
+
+	for name, repo := range map[string]StreamUserRepository{
+		"in-memory": NewInMemoryFindUserRepository(seedUsers(t)...).(StreamUserRepository),
+		"postgres":  NewPostgresFindUserRepository(db).(StreamUserRepository),
+	} {
+		users, errs := repo.FindAllStream(ctx)
+		var ids []int
+		for u := range users {
+			ids = append(ids, u.ID())
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("%s: stream error: %v", name, err)
+		}
+		if fmt.Sprint(ids) != "[1 2 3]" {
+			t.Errorf("%s: streamed ids %v, want [1 2 3]", name, ids)
+		}
+	}
+
+	uploads := NewInMemoryUploadUserRepository()
+	if err := NewStreamUploadUserUseCase(NewPostgresFindUserRepository(db).(StreamUserRepository), uploads).Run(ctx); err != nil {
+		t.Fatalf("StreamUploadUserUseCase.Run: %v", err)
+	}
+	if n := len(uploads.Uploaded()); n != 3 {
+		t.Errorf("uploaded %d streamed users, want 3", n)
+	}
+}
+
+func TestUploadLoopsStopOnCancel(t *testing.T) {
+	for name, run := range map[string]func(context.Context, UploadUserRepository, []*UserDTO) error{
+		"RunAll": func(ctx context.Context, r UploadUserRepository, dtos []*UserDTO) error {
+			return NewUploadUserUseCase(r).RunAll(ctx, dtos)
+		},
+		"Sequential": func(ctx context.Context, r UploadUserRepository, dtos []*UserDTO) error {
+			return NewSequentialUploadUserUseCase(r).Run(ctx, dtos)
+		},
+		"Batch": func(ctx context.Context, r UploadUserRepository, dtos []*UserDTO) error {
+			return NewBatchUploadUserUseCase(r, 1).Run(ctx, dtos)
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		uploaded := 0
+		repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+			uploaded++
+			cancel()
+			return nil
+		}}
+		if err := run(ctx, repo, dtosFor(t, 3)); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: error = %v, want context.Canceled", name, err)
+		}
+		if uploaded != 1 {
+			t.Errorf("%s: uploaded %d users after cancel, want 1", name, uploaded)
+		}
+		cancel()
+	}
+}
+
+// setConfigEnv clears every variable LoadConfig reads and then sets env.
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, key := range []string{"DATABASE_URL", "S3_BUCKET", "S3_KEY_PREFIX", "AWS_REGION", "S3_ENDPOINT_URL", "S3_FORCE_PATH_STYLE", "S3_APP_ID"} {
+		t.Setenv(key, env[key])
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	setConfigEnv(t, map[string]string{"DATABASE_URL": "postgres://localhost/app", "S3_BUCKET": "company", "AWS_REGION": "ap-northeast-1"})
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.DatabaseURL != "postgres://localhost/app" || cfg.S3Bucket != "company" || cfg.S3KeyPrefix != "app/user" || cfg.AWSRegion != "ap-northeast-1" {
+		t.Errorf("LoadConfig = %+v", cfg)
+	}
+
+	setConfigEnv(t, nil)
+	_, err = LoadConfig()
+	if err == nil {
+		t.Fatal("LoadConfig succeeded without DATABASE_URL and S3_BUCKET")
+	}
+	for _, key := range []string{"DATABASE_URL", "S3_BUCKET"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not mention %s", err, key)
+		}
+	}
+}
+
+func TestRunFailsWithoutConfig(t *testing.T) {
+	setConfigEnv(t, nil)
+	if err := run(context.Background()); err == nil || !strings.Contains(err.Error(), "load config") {
+		t.Errorf("run error = %v, want a load config error", err)
+	}
+}
+
+func TestRunWrapsAppErrors(t *testing.T) {
+	// Nothing listens on port 1, so connecting to Postgres is refused.
+	setConfigEnv(t, map[string]string{"DATABASE_URL": "postgres://app@127.0.0.1:1/app?sslmode=disable&connect_timeout=1", "S3_BUCKET": "company"})
+	err := run(context.Background())
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("run error = %v, want it to wrap the *net.OpError from connecting", err)
+	}
+	if !strings.HasPrefix(err.Error(), "build app: connect to postgres: ") {
+		t.Errorf("run error = %q, want it prefixed with build app: connect to postgres:", err)
+	}
+}
+
+func TestExportReturnsUseCaseErrors(t *testing.T) {
+	ctx := context.Background()
+	find := NewFindAllUserUseCase(NewInMemoryFindUserRepository(seedUsers(t)...))
+	failing := NewInMemoryUploadUserRepository()
+	errUpload := errors.New("upload failed")
+	failing.Err = errUpload
+
+	if err := export(ctx, find, NewUploadUserUseCase(failing)); !errors.Is(err, errUpload) {
+		t.Errorf("export error = %v, want it to wrap %v", err, errUpload)
+	}
+	ok := NewInMemoryUploadUserRepository()
+	if err := export(ctx, find, NewUploadUserUseCase(ok)); err != nil || len(ok.Uploaded()) != 3 {
+		t.Errorf("export = %v with %d uploads, want nil and 3", err, len(ok.Uploaded()))
+	}
+}
+
+// fakeMongoCollection serves docs, in order, to Find, applying an
+// {id: {$gt: <id>}} filter and the skip and limit options the way Mongo
+// does. FindOne looks documents up by the id of an {id: <id>} filter.
+type fakeMongoCollection struct {
+	docs  []MongoUser
+	finds int
+}
+
+func (c *fakeMongoCollection) Find(ctx context.Context, filter any, opts ...options.Lister[options.FindOptions]) (*mongo.Cursor, error) {
+	c.finds++
+	var fo options.FindOptions
+	for _, o := range opts {
+		for _, set := range o.List() {
+			if err := set(&fo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	afterID := 0
+	if f := filter.(bson.D); len(f) > 0 {
+		afterID = f[0].Value.(bson.D)[0].Value.(int)
+	}
+	docs := make([]any, 0, len(c.docs))
+	skip := int(aws.ToInt64(fo.Skip))
+	for _, d := range c.docs {
+		if d.Id <= afterID {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		// As in Mongo, a zero limit means no limit.
+		if limit := int(aws.ToInt64(fo.Limit)); limit > 0 && len(docs) == limit {
+			break
+		}
+		docs = append(docs, d)
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (c *fakeMongoCollection) FindOne(ctx context.Context, filter any, opts ...options.Lister[options.FindOneOptions]) *mongo.SingleResult {
+	id := filter.(bson.D)[0].Value
+	for _, d := range c.docs {
+		if d.Id == id {
+			return mongo.NewSingleResultFromDocument(d, nil, nil)
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *fakeMongoCollection) CountDocuments(ctx context.Context, filter any, opts ...options.Lister[options.CountOptions]) (int64, error) {
+	return int64(len(c.docs)), nil
+}
+
+func TestMongoFindUserRepository(t *testing.T) {
+	ctx := context.Background()
+	coll := &fakeMongoCollection{docs: []MongoUser{
+		{Id: 1, Name: "Alice", Email: "Alice@Example.com", StatusCode: 1},
+		{Id: 2, Name: "Bob", Email: "bob@example.com", StatusCode: 2},
+		{Id: 3, Name: "Carol", Email: "carol@example.com", StatusCode: 1},
+	}}
+	repo := NewMongoFindUserRepository(coll)
+
+	users, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if len(users) != 3 || !users[0].Equal(mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)) {
+		t.Errorf("FindAll = %v, want the three documents through NewUser", users)
+	}
+	if u, err := repo.FindByID(ctx, 2); err != nil || u.Name() != "Bob" {
+		t.Errorf("FindByID(2) = %v, %v, want Bob", u, err)
+	}
+	if _, err := repo.FindByID(ctx, 4); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindByID(4) error = %v, want ErrUserNotFound", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		find func() ([]*User, error)
+		want string
+	}{
+		{"FindPage(2, 0)", func() ([]*User, error) { return repo.FindPage(ctx, 2, 0) }, "[1 2]"},
+		{"FindPage(2, 2)", func() ([]*User, error) { return repo.FindPage(ctx, 2, 2) }, "[3]"},
+		{"FindPage(2, 5)", func() ([]*User, error) { return repo.FindPage(ctx, 2, 5) }, "[]"},
+		{"FindAfter(1, 1)", func() ([]*User, error) { return repo.FindAfter(ctx, 1, 1) }, "[2]"},
+		{"FindAfter(2, 5)", func() ([]*User, error) { return repo.FindAfter(ctx, 2, 5) }, "[3]"},
+	} {
+		users, err := tt.find()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var ids []int
+		for _, u := range users {
+			ids = append(ids, u.ID())
+		}
+		if fmt.Sprint(ids) != tt.want {
+			t.Errorf("%s = ids %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+
+	// Mongo reads a zero limit as no limit, so it must not reach Find.
+	finds := coll.finds
+	if users, err := repo.FindPage(ctx, 0, 0); err != nil || len(users) != 0 {
+		t.Errorf("FindPage(0, 0) = %v, %v, want no users", users, err)
+	}
+	if users, err := repo.FindAfter(ctx, 0, 0); err != nil || len(users) != 0 {
+		t.Errorf("FindAfter(0, 0) = %v, %v, want no users", users, err)
+	}
+	if coll.finds != finds {
+		t.Errorf("a zero limit reached Find %d times, want 0", coll.finds-finds)
+	}
+	if _, err := repo.FindPage(ctx, -1, 0); err == nil {
+		t.Error("FindPage with a negative limit succeeded")
+	}
+	if _, err := repo.FindPage(ctx, 1, -1); err == nil {
+		t.Error("FindPage with a negative offset succeeded")
+	}
+	if _, err := repo.FindAfter(ctx, 0, -1); err == nil {
+		t.Error("FindAfter with a negative limit succeeded")
+	}
+
+	invalid := NewMongoFindUserRepository(&fakeMongoCollection{docs: []MongoUser{{Id: 1, Name: "Alice", Email: "alice", StatusCode: 1}}})
+	if _, err := invalid.FindAll(ctx); err == nil {
+		t.Error("FindAll accepted a document with an invalid email")
+	}
+}
+
+type fakeDynamoDB struct{ puts []*dynamodb.PutItemInput }
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.puts = append(f.puts, in)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoDBUploadUserRepository(t *testing.T) {
+	client := &fakeDynamoDB{}
+	user := mustNewUser(t, 4, "Dave", "dave@example.com", StatusInactive)
+	if err := NewDynamoDBUploadUserRepository(client, "users").Upload(context.Background(), user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if len(client.puts) != 1 || aws.ToString(client.puts[0].TableName) != "users" {
+		t.Fatalf("PutItem calls = %v, want one on table users", client.puts)
+	}
+	var got DynamoDBUser
+	if err := attributevalue.UnmarshalMap(client.puts[0].Item, &got); err != nil {
+		t.Fatalf("UnmarshalMap: %v", err)
+	}
+	if want := (DynamoDBUser{Id: 4, Name: "Dave", Email: "dave@example.com", StatusCode: 2}); got != want {
+		t.Errorf("item = %+v, want %+v", got, want)
+	}
+}
+
+// fakeMultipartS3 is a fakeS3 that also accepts multipart uploads and counts
+// how many were started.
+type fakeMultipartS3 struct {
+	*fakeS3
+	multipart atomic.Int32
+}
+
+func (f *fakeMultipartS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.multipart.Add(1)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeMultipartS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if _, err := io.Copy(io.Discard, in.Body); err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"part-%d"`, aws.ToInt32(in.PartNumber)))}, nil
+}
+
+func (f *fakeMultipartS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipartS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestPutObjectMultipartThreshold(t *testing.T) {
+	ctx := context.Background()
+	const threshold = 1 << 20
+	for _, tt := range []struct {
+		name          string
+		size          int
+		wantMultipart bool
+	}{
+		{"small body", 1 << 10, false},
+		// The manager only splits bodies larger than its 5 MiB minimum part size.
+		{"large body", 6 << 20, true},
+	} {
+		client := &fakeMultipartS3{fakeS3: newFakeS3()}
+		body := bytes.Repeat([]byte("x"), tt.size)
+		input := &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("users/users.ndjson"), Body: bytes.NewReader(body), ContentType: aws.String("application/x-ndjson")}
+		if err := putObject(ctx, client, input, int64(len(body)), threshold); err != nil {
+			t.Fatalf("%s: putObject: %v", tt.name, err)
+		}
+		if got := client.multipart.Load() > 0; got != tt.wantMultipart {
+			t.Errorf("%s: multipart = %v, want %v", tt.name, got, tt.wantMultipart)
+		}
+		if got := client.putCount() > 0; got == tt.wantMultipart {
+			t.Errorf("%s: PutObject used = %v, want %v", tt.name, got, !tt.wantMultipart)
+		}
+	}
+}
+
+func TestS3UploadWithHash(t *testing.T) {
+	for name, opts := range map[string][]S3UploadOption{
+		"plain": nil,
+		"gzip":  {WithGzip()},
+	} {
+		client := newFakeS3()
+		var repo HashUploadUserRepository = newS3Repo(t, client, opts...)
+		hash, err := repo.UploadWithHash(context.Background(), mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive))
+		if err != nil {
+			t.Fatalf("%s: UploadWithHash: %v", name, err)
+		}
+		in := client.lastPut(t)
+		sum := sha256.Sum256(client.body(t, aws.ToString(in.Key)))
+		if want := hex.EncodeToString(sum[:]); hash != want || in.Metadata["content-sha256"] != want {
+			t.Errorf("%s: hash = %q, metadata = %q, want the body digest %q", name, hash, in.Metadata["content-sha256"], want)
+		}
+	}
+}
+
+func TestSuspendUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	insertUsers(t, db, seedUsers(t)...)
+	uc := NewSuspendUserUseCase(NewPostgresFindUserRepository(db), NewPostgresUpdateUserRepository(db))
+
+	dto, err := uc.Run(ctx, 1)
+	if err != nil {
+		t.Fatalf("Run(1): %v", err)
+	}
+	if dto.StatusCode != int(StatusSuspended) {
+		t.Errorf("returned status = %d, want %d", dto.StatusCode, StatusSuspended)
+	}
+	stored, err := NewPostgresFindUserRepository(db).FindByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.StatusCode() != StatusSuspended {
+		t.Errorf("stored status = %d, want %d", stored.StatusCode(), StatusSuspended)
+	}
+
+	if _, err := uc.Run(ctx, 1); !errors.Is(err, ErrIllegalStatusTransition) {
+		t.Errorf("second Run(1) error = %v, want ErrIllegalStatusTransition", err)
+	}
+	if _, err := uc.Run(ctx, 99); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Run(99) error = %v, want ErrUserNotFound", err)
+	}
+}
+
+// mustNewUnsavedUserDTO returns an active user without an id, mailed at the
+// lower-cased name.
+func mustNewUnsavedUserDTO(t testing.TB, name string) *UserDTO {
+	t.Helper()
+	dto, err := NewUnsavedUserDTO(name, strings.ToLower(name)+"@example.com", int(StatusActive))
+	if err != nil {
+		t.Fatalf("NewUnsavedUserDTO(%q): %v", name, err)
+	}
+	return dto
+}
+
+func TestCreateUserUseCasePublishesUserCreated(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	publisher := NewInMemoryEventPublisher()
+	uc := NewCreateUserUseCase(NewPostgresCreateUserRepository(db), WithEventPublisher(publisher))
+
+	for _, name := range []string{"Alice", "Bob"} {
+		if _, err := uc.Run(ctx, mustNewUnsavedUserDTO(t, name)); err != nil {
+			t.Fatalf("Run(%s): %v", name, err)
+		}
+	}
+	if _, err := uc.Run(ctx, mustNewUnsavedUserDTO(t, "Alice")); err == nil {
+		t.Fatal("Run succeeded with a duplicate email")
+	}
+
+	events := publisher.Published()
+	if len(events) != 2 {
+		t.Fatalf("published %d events, want one per created user", len(events))
+	}
+	if got := events[1].(UserCreated); got.UserID != 2 || got.Email != "bob@example.com" {
+		t.Errorf("second event = %+v, want user 2 bob@example.com", got)
+	}
+}
+
+func TestUploadUserUseCaseIdempotency(t *testing.T) {
+	ctx := context.Background()
+	if NewUploadUserUseCase(NewInMemoryUploadUserRepository()).tracksIdempotency() {
+		t.Error("default usecase tracks idempotency keys, want them skipped")
+	}
+	db := newSQLiteUserDB(t)
+	if _, err := db.Exec(`CREATE TABLE app.upload_idempotency (idempotency_key TEXT PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]IdempotencyStore{
+		"in-memory": NewInMemoryIdempotencyStore(),
+		"postgres":  NewPostgresIdempotencyStore(db),
+	} {
+		client := newFakeS3()
+		uc := NewUploadUserUseCase(newS3Repo(t, client), WithIdempotencyStore(store))
+		dto := dtosFor(t, 1)[0]
+		for range 2 {
+			if err := uc.Run(ctx, dto); err != nil {
+				t.Fatalf("%s: Run: %v", name, err)
+			}
+		}
+		if n := client.putCount(); n != 1 {
+			t.Errorf("%s: same user uploaded with %d PutObject calls, want 1", name, n)
+		}
+		dto.Name = "Renamed"
+		if err := uc.Run(ctx, dto); err != nil {
+			t.Fatalf("%s: Run: %v", name, err)
+		}
+		if n := client.putCount(); n != 2 {
+			t.Errorf("%s: changed user gave %d PutObject calls in total, want 2", name, n)
+		}
+	}
+}
+
+func TestUploadUserUseCaseRateLimit(t *testing.T) {
+	uc := NewUploadUserUseCase(NewInMemoryUploadUserRepository(), WithRateLimit(10))
+	start := time.Now()
+	if err := uc.RunAll(context.Background(), dtosFor(t, 5)); err != nil {
+		t.Fatalf("RunAll: %v", err)
+	}
+	// The first token is free, the other four arrive 100ms apart.
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("5 uploads at 10 rps took %v, want at least ~400ms", elapsed)
+	}
+
+	slow := NewUploadUserUseCase(NewInMemoryUploadUserRepository(), WithRateLimit(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- slow.RunAll(ctx, dtosFor(t, 3)) }()
+	select {
+	case err := <-done:
+		// The limiter fails at once when the deadline falls before the next token.
+		if err == nil {
+			t.Error("RunAll succeeded, want the wait to fail once ctx expires")
+		}
+	case <-time.After(time.Second):
+		t.Error("RunAll still waiting for a token after ctx expired")
+	}
+}
+
+func TestCompositeHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	unreachable := newFakeS3()
+	errUnreachable := errors.New("bucket unreachable")
+	unreachable.err = errUnreachable
+
+	h := NewCompositeHealthChecker()
+	h.Register("postgres", NewPostgresFindUserRepository(newSQLiteUserDB(t)).(HealthChecker))
+	h.Register("s3", newS3Repo(t, newFakeS3()))
+	if err := h.Ping(ctx); err != nil {
+		t.Fatalf("Ping with healthy checks: %v", err)
+	}
+
+	h.Register("s3", newS3Repo(t, unreachable))
+	err := h.Ping(ctx)
+	if !errors.Is(err, errUnreachable) || !strings.Contains(err.Error(), "s3: ") {
+		t.Errorf("Ping error = %v, want the s3 failure", err)
+	}
+	if strings.Contains(err.Error(), "postgres") {
+		t.Errorf("Ping error %q reports the healthy postgres check", err)
+	}
+}
+
+// refusingConnector counts connection attempts and fails every one of them.
+type refusingConnector struct{ attempts atomic.Int32 }
+
+func (c *refusingConnector) Connect(context.Context) (driver.Conn, error) {
+	c.attempts.Add(1)
+	return nil, errors.New("connection refused")
+}
+
+func (c *refusingConnector) Driver() driver.Driver { return nil }
+
+func TestBulkCreateValidatesBeforeCopying(t *testing.T) {
+	ctx := context.Background()
+	conn := &refusingConnector{}
+	db := sqlx.NewDb(sql.OpenDB(conn), "postgres")
+	defer db.Close()
+	repo := NewPostgresBulkCreateUserRepository(db)
+
+	users := append(seedUsers(t), NewUserUnchecked(4, "Dave", "not-an-email", StatusActive))
+	err := repo.BulkCreate(ctx, users)
+	if err == nil || !strings.Contains(err.Error(), "user id 4") {
+		t.Errorf("BulkCreate error = %v, want the validation error for user 4", err)
+	}
+	if n := conn.attempts.Load(); n != 0 {
+		t.Errorf("BulkCreate touched the database %d times before failing validation, want 0", n)
+	}
+
+	if err := repo.BulkCreate(ctx, seedUsers(t)); err == nil {
+		t.Fatal("BulkCreate succeeded without a database")
+	}
+	if conn.attempts.Load() == 0 {
+		t.Error("BulkCreate with valid users never reached the database")
+	}
+}
+
+func TestFindAllUserUseCaseWithMockRepository(t *testing.T) {
+	ctx := context.Background()
+	errCrafted := fmt.Errorf("replica lag: %w", ErrUserNotFound)
+	repo := &MockFindUserRepository{
+		FindAllFunc: func(ctx context.Context) ([]*User, error) { return nil, errCrafted },
+	}
+
+	dtos, err := NewFindAllUserUseCase(repo).Run(ctx)
+	if !errors.Is(err, errCrafted) || !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Run error = %v, want the crafted error", err)
+	}
+	if dtos != nil {
+		t.Errorf("Run returned %v alongside the error, want nil", dtos)
+	}
+	if _, err := NewCountUserUseCase(repo).Run(ctx); err == nil || !strings.Contains(err.Error(), "CountFunc is not set") {
+		t.Errorf("Count with no CountFunc error = %v, want the not-set error", err)
+	}
+}
+
+func TestS3UploadWritesSchemaVersion(t *testing.T) {
+	client := newFakeS3()
+	if err := newS3Repo(t, client).Upload(context.Background(), mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(client.body(t, "users/user-1.json"), &payload); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got, ok := payload["schema_version"]; !ok || got != float64(S3UserSchemaVersion) {
+		t.Errorf("schema_version = %v (present %t), want %d", got, ok, S3UserSchemaVersion)
+	}
+}
+
+func TestXMLUploadUserRepositoryRoundTrip(t *testing.T) {
+	client := newFakeS3()
+	user := mustNewUser(t, 2, "Bob", "bob@example.com", StatusInactive)
+	if err := NewXMLUploadUserRepository(client, "bucket", "users").Upload(context.Background(), user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := aws.ToString(client.lastPut(t).ContentType); got != "application/xml" {
+		t.Errorf("ContentType = %q, want application/xml", got)
+	}
+	var got XMLUser
+	if err := xml.Unmarshal(client.body(t, "users/user-2.xml"), &got); err != nil {
+		t.Fatalf("xml.Unmarshal: %v", err)
+	}
+	if got.Id != 2 || got.Name != "Bob" || got.Email != "bob@example.com" || got.StatusCode != int(StatusInactive) {
+		t.Errorf("round-tripped user = %+v, want Bob with id 2 and status %d", got, StatusInactive)
+	}
+}
+
+func TestParquetExportReadBack(t *testing.T) {
+	ctx := context.Background()
+	dtos := dtosFor(t, 5)
+
+	var buf bytes.Buffer
+	repo := &ParquetExportUserRepository{w: &buf, rowGroupSize: 2}
+	if err := NewExportUsersUseCase(repo).Run(ctx, dtos); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if n := len(file.RowGroups()); n != 3 {
+		t.Errorf("%d row groups for 5 users in batches of 2, want 3", n)
+	}
+	rows, err := parquet.Read[ParquetUser](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("parquet.Read: %v", err)
+	}
+	if len(rows) != len(dtos) {
+		t.Fatalf("read %d rows, want %d", len(rows), len(dtos))
+	}
+	for i, dto := range dtos {
+		want := ParquetUser{Id: int64(dto.ID), Name: dto.Name, Email: dto.Email, StatusCode: int64(dto.StatusCode)}
+		if rows[i] != want {
+			t.Errorf("row %d = %+v, want %+v", i, rows[i], want)
+		}
+	}
+
+	var empty bytes.Buffer
+	if err := NewParquetExportUseCase(&empty).Run(ctx, nil); err != nil {
+		t.Fatalf("Run with no users: %v", err)
+	}
+	rows, err = parquet.Read[ParquetUser](bytes.NewReader(empty.Bytes()), int64(empty.Len()))
+	if err != nil || len(rows) != 0 {
+		t.Errorf("empty export read back %d rows, %v, want a valid file with none", len(rows), err)
+	}
+}
+
+func TestHTTPFindUserRepository(t *testing.T) {
+	ctx := context.Background()
+	serve := func(body string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != "/users" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, body)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	srv := serve(`[{"id":1,"name":"Alice","email":"alice@example.com","status_code":1},{"id":2,"name":"Bob","email":"bob@example.com","status_code":2}]`)
+	users, err := NewHTTPFindUserRepository(srv.Client(), srv.URL+"/").FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if len(users) != 2 || users[0].Name() != "Alice" || users[1].StatusCode() != StatusInactive {
+		t.Errorf("FindAll = %v, want Alice and an inactive Bob", users)
+	}
+
+	bad := serve(`[{"id":1,"name":"Alice","email":"alice@example.com","status_code":1},{"id":2,"name":"Bob","email":"not-an-email","status_code":1}]`)
+	_, err = NewHTTPFindUserRepository(bad.Client(), bad.URL).FindAll(ctx)
+	if err == nil || !strings.Contains(err.Error(), "/users: user 1: ") {
+		t.Errorf("FindAll with a malformed record error = %v, want a validation error naming user 1", err)
+	}
+}
+
+func TestLogsCarryCorrelationID(t *testing.T) {
+	logger, records := captureLogger(t)
+	uc := NewUploadUserUseCase(NewInMemoryUploadUserRepository(), WithLogger(logger))
+
+	if err := uc.Run(WithCorrelationID(context.Background(), "batch-42"), dtosFor(t, 1)[0]); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := uc.Run(context.Background(), dtosFor(t, 1)[0]); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var with, without int
+	for _, rec := range records() {
+		switch id, ok := rec["correlation_id"]; {
+		case !ok:
+			without++
+		case id == "batch-42":
+			with++
+		default:
+			t.Errorf("record %v has correlation_id %v, want batch-42", rec, id)
+		}
+	}
+	if with == 0 || without == 0 {
+		t.Errorf("%d records with the id and %d without, want some of each", with, without)
+	}
+	if id := newCorrelationID(); id == "" || id == newCorrelationID() {
+		t.Errorf("newCorrelationID() = %q, want a fresh non-empty id each call", id)
+	}
+}
+
+func TestFindAllUserUseCaseContinueOnInvalid(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	if _, err := db.Exec(`INSERT INTO app.user (id, name, email, status_code) VALUES (1, 'Alice', 'alice@example.com', 1), (2, 'Bob', 'not-an-email', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresFindUserRepository(db)
+
+	if _, err := NewFindAllUserUseCase(repo).Run(ctx); err == nil {
+		t.Error("Run without ContinueOnInvalid succeeded, want the invalid row to fail the load")
+	}
+	dtos, rejected, err := NewFindAllUserUseCase(repo, ContinueOnInvalid()).RunWithRejected(ctx)
+	if err != nil {
+		t.Fatalf("RunWithRejected: %v", err)
+	}
+	if len(dtos) != 1 || dtos[0].ID != 1 {
+		t.Errorf("valid users = %+v, want only Alice", dtos)
+	}
+	if len(rejected) != 1 || rejected[0].ID != 2 || rejected[0].Err == nil {
+		t.Errorf("rejected = %+v, want Bob and the validation error", rejected)
+	}
+}
+
+func TestRetryFindUserRepositoryRetriesTransientErrors(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	flaky := &MockFindUserRepository{FindAllFunc: func(ctx context.Context) ([]*User, error) {
+		calls++
+		if calls == 1 {
+			return nil, &pq.Error{Code: "08006"}
+		}
+		return seedUsers(t), nil
+	}}
+	users, err := NewRetryFindUserRepository(flaky, 3, time.Millisecond).FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll after a dropped connection: %v", err)
+	}
+	if len(users) != 3 || calls != 2 {
+		t.Errorf("FindAll = %d users after %d attempts, want 3 after 2", len(users), calls)
+	}
+
+	calls = 0
+	missing := &MockFindUserRepository{FindByIDFunc: func(ctx context.Context, id int) (*User, error) {
+		calls++
+		return nil, ErrUserNotFound
+	}}
+	if _, err := NewRetryFindUserRepository(missing, 3, time.Millisecond).FindByID(ctx, 1); !errors.Is(err, ErrUserNotFound) || calls != 1 {
+		t.Errorf("FindByID = %v after %d attempts, want ErrUserNotFound after 1", err, calls)
+	}
+}
+
+func TestS3UploadWithFieldMap(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	keys := func(client *fakeS3) map[string]any {
+		t.Helper()
+		var payload map[string]any
+		if err := json.Unmarshal(client.body(t, "users/user-1.json"), &payload); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		return payload
+	}
+
+	mapped := newFakeS3()
+	if err := newS3Repo(t, mapped, WithFieldMap(map[string]string{"status_code": "state"})).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	got := keys(mapped)
+	if _, ok := got["status_code"]; ok || got["state"] != float64(StatusActive) || got["name"] != "Alice" {
+		t.Errorf("mapped payload = %v, want state instead of status_code and other keys unchanged", got)
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := keys(plain); got["status_code"] != float64(StatusActive) {
+		t.Errorf("default payload = %v, want status_code", got)
+	}
+
+	if _, err := NewS3UploadUserRepository(newFakeS3(), "bucket", "users", WithFieldMap(map[string]string{"name": "id"})); err == nil {
+		t.Error("WithFieldMap renaming name onto id succeeded, want a duplicate name error")
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestAppCloseJoinsErrors(t *testing.T) {
+	errDB := errors.New("close db")
+	errCache := errors.New("close cache")
+	var order []string
+	app := &App{closers: []io.Closer{
+		closerFunc(func() error { order = append(order, "db"); return errDB }),
+		closerFunc(func() error { order = append(order, "client"); return nil }),
+		closerFunc(func() error { order = append(order, "cache"); return errCache }),
+	}}
+
+	err := app.Close()
+	if !errors.Is(err, errDB) || !errors.Is(err, errCache) {
+		t.Errorf("Close error = %v, want both %v and %v", err, errDB, errCache)
+	}
+	if want := []string{"cache", "client", "db"}; fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("closed in order %v, want %v", order, want)
+	}
+	if err := app.Close(); err != nil {
+		t.Errorf("second Close error = %v, want nil", err)
+	}
+}
+
+func TestSQLRepositoriesCloseTheirDB(t *testing.T) {
+	for name, newRepo := range map[string]func(db *sqlx.DB) any{
+		"find":        func(db *sqlx.DB) any { return NewPostgresFindUserRepository(db) },
+		"create":      func(db *sqlx.DB) any { return NewPostgresCreateUserRepository(db) },
+		"upsert":      func(db *sqlx.DB) any { return NewPostgresUpsertUserRepository(db) },
+		"bulk create": func(db *sqlx.DB) any { return NewPostgresBulkCreateUserRepository(db) },
+		"delete":      func(db *sqlx.DB) any { return NewPostgresDeleteUserRepository(db) },
+		"update":      func(db *sqlx.DB) any { return NewPostgresUpdateUserRepository(db) },
+		"sqlite":      func(db *sqlx.DB) any { return NewSQLiteFindUserRepository(db) },
+	} {
+		db := newSQLiteUserDB(t)
+		closer, ok := newRepo(db).(io.Closer)
+		if !ok {
+			t.Errorf("%s repository does not implement io.Closer", name)
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			t.Errorf("%s repository Close: %v", name, err)
+		}
+		if err := db.Ping(); err == nil {
+			t.Errorf("db still open after closing the %s repository", name)
+		}
+	}
+
+	// Inside a transaction there is no db to close.
+	db := newSQLiteUserDB(t)
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (PostgresCreateUserRepository{db: tx}).Close(); err != nil {
+		t.Errorf("Close inside a transaction: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Errorf("Close inside a transaction closed the db: %v", err)
+	}
+}
+
+func TestS3UploadWithContentDisposition(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 7, "Gina", "gina@example.com", StatusActive)
+
+	client := newFakeS3()
+	if err := newS3Repo(t, client, WithContentDisposition()).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got, want := aws.ToString(client.lastPut(t).ContentDisposition), `attachment; filename="user-7.json"`; got != want {
+		t.Errorf("ContentDisposition = %q, want %q", got, want)
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if cd := plain.lastPut(t).ContentDisposition; cd != nil {
+		t.Errorf("ContentDisposition = %q without the option, want unset", *cd)
+	}
+}
+
+// usersFor returns n valid active users with ids 1 to n, named like dtosFor.
+func usersFor(t testing.TB, n int) []*User {
+	t.Helper()
+	users := make([]*User, 0, n)
+	for id := 1; id <= n; id++ {
+		users = append(users, mustNewUser(t, id, fmt.Sprintf("User %d", id), fmt.Sprintf("user%d@example.com", id), StatusActive))
+	}
+	return users
+}
+
+func BenchmarkFindAllDTO(b *testing.B) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(b)
+	insertUsers(b, db, usersFor(b, 1000)...)
+	uc := NewFindAllUserUseCase(NewPostgresFindUserRepository(db))
+
+	b.Run("Run", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := uc.Run(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("RunDTO", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := uc.RunDTO(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFindAllUserUseCaseRunDTOMatchesRun(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteUserDB(t)
+	insertUsers(t, db, usersFor(t, 5)...)
+	uc := NewFindAllUserUseCase(NewPostgresFindUserRepository(db))
+
+	want, err := uc.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err := uc.RunDTO(ctx)
+	if err != nil {
+		t.Fatalf("RunDTO: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("RunDTO returned %d users, Run %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("user %d: RunDTO = %+v, Run = %+v", i, *got[i], *want[i])
+		}
+	}
+}
+
+// fakeUpsertRepo stores users by email the way the Postgres upsert does,
+// assigning ids from 1 on insert.
+type fakeUpsertRepo struct{ byEmail map[string]*User }
+
+func (r *fakeUpsertRepo) Upsert(ctx context.Context, user *User) (bool, error) {
+	if stored, ok := r.byEmail[user.Email()]; ok {
+		user.id = stored.ID()
+		r.byEmail[user.Email()] = user
+		return false, nil
+	}
+	if user.ID() == 0 {
+		user.id = len(r.byEmail) + 1
+	}
+	r.byEmail[user.Email()] = user
+	return true, nil
+}
+
+func TestUpsertUserUseCaseReportsInsertAndUpdate(t *testing.T) {
+	ctx := context.Background()
+	repo := &fakeUpsertRepo{byEmail: map[string]*User{}}
+	publisher := NewInMemoryEventPublisher()
+	uc := NewUpsertUserUseCase(repo, WithEventPublisher(publisher))
+
+	first, inserted, err := uc.Run(ctx, mustNewUnsavedUserDTO(t, "Alice"))
+	if err != nil || !inserted {
+		t.Fatalf("first Run = inserted %t, %v, want an insert", inserted, err)
+	}
+	renamed, err := NewUnsavedUserDTO("Alice Smith", "ALICE@example.com", int(StatusInactive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, inserted, err := uc.Run(ctx, renamed)
+	if err != nil || inserted {
+		t.Fatalf("second Run = inserted %t, %v, want an update", inserted, err)
+	}
+	if second.ID != first.ID || second.Name != "Alice Smith" || second.StatusCode != int(StatusInactive) {
+		t.Errorf("updated user = %+v, want id %d with the new name and status", second, first.ID)
+	}
+	if n := len(repo.byEmail); n != 1 {
+		t.Errorf("%d users stored, want 1", n)
+	}
+	if n := len(publisher.Published()); n != 1 {
+		t.Errorf("%d events published, want 1 for the insert only", n)
+	}
+}
+
+func TestBatchUploadUserUseCaseRejectsDuplicateEmails(t *testing.T) {
+	dtos := dtosFor(t, 3)
+	dtos[2].Email = "User1@Example.com"
+	uploads := 0
+	repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		uploads++
+		return nil
+	}}
+
+	err := NewBatchUploadUserUseCase(repo, 2, WithUniqueEmails()).Run(context.Background(), dtos)
+	if !errors.Is(err, ErrDuplicateEmail) || !strings.Contains(err.Error(), "user1@example.com") {
+		t.Errorf("Run error = %v, want ErrDuplicateEmail naming user1@example.com", err)
+	}
+	if uploads != 0 {
+		t.Errorf("%d uploads happened before the duplicate was reported, want 0", uploads)
+	}
+}
+
+func TestS3UploadWithCompactJSON(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+
+	pretty := newFakeS3()
+	if err := newS3Repo(t, pretty).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	compact := newFakeS3()
+	if err := newS3Repo(t, compact, WithCompactJSON()).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	prettyBody, compactBody := pretty.body(t, "users/user-1.json"), compact.body(t, "users/user-1.json")
+	if bytes.Equal(prettyBody, compactBody) || bytes.ContainsAny(compactBody, "\n ") {
+		t.Errorf("compact body = %s, want no indentation and different from %s", compactBody, prettyBody)
+	}
+	var fromPretty, fromCompact S3User
+	if err := json.Unmarshal(prettyBody, &fromPretty); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(compactBody, &fromCompact); err != nil {
+		t.Fatal(err)
+	}
+	if fromPretty != fromCompact {
+		t.Errorf("compact body decodes to %+v, pretty to %+v", fromCompact, fromPretty)
+	}
+
+	gzipped := newFakeS3()
+	if err := newS3Repo(t, gzipped, WithCompactJSON(), WithGzip()).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped.body(t, "users/user-1.json.gz")))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, compactBody) {
+		t.Errorf("decompressed body = %s, %v, want %s", got, err, compactBody)
+	}
+}
+
+func TestBatchUploadUserUseCaseReportsProgress(t *testing.T) {
+	repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		if user.ID() == 2 {
+			return errors.New("boom")
+		}
+		return nil
+	}}
+	var calls [][2]int
+	progress := WithProgress(func(done, total int) { calls = append(calls, [2]int{done, total}) })
+
+	if err := NewBatchUploadUserUseCase(repo, 3, progress).Run(context.Background(), dtosFor(t, 3)); err == nil {
+		t.Fatal("Run succeeded, want the failure of user 2")
+	}
+	if want := [][2]int{{1, 3}, {2, 3}, {3, 3}}; fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("progress calls = %v, want %v", calls, want)
+	}
+}
+
+func TestMultiUploadUserRepository(t *testing.T) {
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	errS3 := errors.New("s3 down")
+	for _, parallel := range []bool{false, true} {
+		var s3Calls atomic.Int32
+		failing := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+			s3Calls.Add(1)
+			return errS3
+		}}
+		healthy := NewInMemoryUploadUserRepository()
+
+		err := NewMultiUploadUserRepository(parallel, failing, healthy).Upload(context.Background(), user)
+		if !errors.Is(err, errS3) {
+			t.Errorf("parallel=%t: Upload error = %v, want %v", parallel, err, errS3)
+		}
+		if n := s3Calls.Load(); n != 1 {
+			t.Errorf("parallel=%t: failing backend called %d times, want 1", parallel, n)
+		}
+		if n := len(healthy.Uploaded()); n != 1 {
+			t.Errorf("parallel=%t: healthy backend got %d uploads after the other failed, want 1", parallel, n)
+		}
+	}
+
+	errGCS := errors.New("gcs down")
+	gcs := NewInMemoryUploadUserRepository()
+	gcs.Err = errGCS
+	s3Repo := NewInMemoryUploadUserRepository()
+	s3Repo.Err = errS3
+	if err := NewMultiUploadUserRepository(true, s3Repo, gcs).Upload(context.Background(), user); !errors.Is(err, errS3) || !errors.Is(err, errGCS) {
+		t.Errorf("Upload error = %v, want both backend errors joined", err)
+	}
+}
+
+func TestBatchUploadUserUseCaseDeadLetters(t *testing.T) {
+	attempts := map[int]int{}
+	var mu sync.Mutex
+	flaky := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[user.ID()]++
+		if user.ID() == 2 {
+			return timeoutErr{}
+		}
+		return nil
+	}}
+	repo := NewRetryUploadUserRepository(flaky, 3, time.Millisecond)
+	sink := NewInMemoryDeadLetterSink()
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	fileSink := NewJSONLFileDeadLetterSink(path)
+
+	for _, s := range []DeadLetterSink{sink, fileSink} {
+		if err := NewBatchUploadUserUseCase(repo, 2, WithDeadLetterSink(s)).Run(context.Background(), dtosFor(t, 3)); err == nil {
+			t.Fatal("Run succeeded, want the failure of user 2")
+		}
+	}
+	if attempts[2] != 6 {
+		t.Errorf("user 2 attempted %d times over two runs, want 3 each", attempts[2])
+	}
+	letters := sink.Recorded()
+	if len(letters) != 1 || letters[0].User.ID != 2 || !errors.As(letters[0].Err, new(timeoutErr)) {
+		t.Errorf("dead letters = %+v, want user 2 once with its timeout", letters)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line deadLetterLine
+	if lines := bytes.Split(bytes.TrimSpace(data), []byte("\n")); len(lines) != 1 {
+		t.Fatalf("dead letter file has %d lines, want 1", len(lines))
+	}
+	if err := json.Unmarshal(data, &line); err != nil || line.ID != 2 || line.Error != "i/o timeout" {
+		t.Errorf("dead letter line = %+v, %v, want user 2 with the timeout", line, err)
+	}
+}
+
+func TestFindAllMapUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	byID, err := NewFindAllMapUserUseCase(NewInMemoryFindUserRepository(seedUsers(t)...)).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(byID) != 3 || byID[2].Name != "Bob" {
+		t.Errorf("Run = %v, want the three seeded users keyed by id", byID)
+	}
+
+	corrupt := NewInMemoryFindUserRepository(
+		mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive),
+		mustNewUser(t, 1, "Alias", "alias@example.com", StatusActive),
+	)
+	byID, err = NewFindAllMapUserUseCase(corrupt).Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "user id 1 is stored more than once") {
+		t.Errorf("Run error = %v, want the duplicate id 1 error", err)
+	}
+	if byID != nil {
+		t.Errorf("Run returned %v alongside the error, want nil", byID)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper that answers every request itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// newInterceptedS3Client builds an S3 client from the environment with cfg
+// and an HTTP client that records each request instead of sending it.
+func newInterceptedS3Client(t *testing.T, cfg *Config) (*s3.Client, func() []*http.Request) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_PROFILE", "")
+	// A CA bundle can only be applied to the SDK's own HTTP client.
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+	)
+	cfg.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Body != nil {
+			// The SDK computes the checksum while the body is read.
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return nil, err
+			}
+		}
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	})}
+	client, err := newS3Client(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	return client, func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*http.Request(nil), requests...)
+	}
+}
+
+func TestS3ClientCustomEndpoint(t *testing.T) {
+	ctx := context.Background()
+	put := &s3.PutObjectInput{Bucket: aws.String("company"), Key: aws.String("users/user-1.json"), Body: strings.NewReader("{}")}
+
+	setConfigEnv(t, map[string]string{"DATABASE_URL": "postgres://localhost/app", "S3_BUCKET": "company", "AWS_REGION": "us-east-1", "S3_ENDPOINT_URL": "http://minio.local:9000", "S3_FORCE_PATH_STYLE": "true"})
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	client, requests := newInterceptedS3Client(t, cfg)
+	if _, err := client.PutObject(ctx, put); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if got := requests(); len(got) != 1 || got[0].URL.Host != "minio.local:9000" || got[0].URL.Path != "/company/users/user-1.json" {
+		t.Errorf("requests = %v, want one path-style request to minio.local:9000", got)
+	}
+
+	setConfigEnv(t, map[string]string{"DATABASE_URL": "postgres://localhost/app", "S3_BUCKET": "company", "AWS_REGION": "us-east-1"})
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	client, requests = newInterceptedS3Client(t, cfg)
+	put.Body = strings.NewReader("{}")
+	if _, err := client.PutObject(ctx, put); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if got := requests(); len(got) != 1 || got[0].URL.Host != "company.s3.us-east-1.amazonaws.com" {
+		t.Errorf("requests = %v, want one virtual-hosted request to AWS", got)
+	}
+}
+
+// tamperingS3 stores objects like fakeS3 but hands back a corrupted body.
+type tamperingS3 struct{ *fakeS3 }
+
+func (f tamperingS3) GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if _, err := f.fakeS3.GetObject(ctx, in, opts...); err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(`{"id":1}`))}, nil
+}
+
+func TestS3UploadWithVerify(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+
+	if err := newS3Repo(t, newFakeS3(), WithVerify()).Upload(ctx, user); err != nil {
+		t.Errorf("Upload with an intact object: %v", err)
+	}
+	err := newS3Repo(t, tamperingS3{newFakeS3()}, WithVerify()).Upload(ctx, user)
+	if err == nil || !strings.Contains(err.Error(), "verify users/user-1.json: stored 8 bytes differ") {
+		t.Errorf("Upload with an altered object error = %v, want a verify mismatch", err)
+	}
+
+	putOnly := struct{ S3PutObjectAPI }{newFakeS3()}
+	if _, err := NewS3UploadUserRepository(putOnly, "bucket", "users", WithVerify()); err == nil {
+		t.Error("WithVerify on a client without GetObject succeeded, want an error")
+	}
+}
+
+// pagingS3 lists at most pageSize keys per ListObjectsV2 call, continuing
+// from the key in the continuation token.
+type pagingS3 struct {
+	*fakeS3
+	pageSize int
+	lists    int
+}
+
+func (f *pagingS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.lists++
+	all, err := f.fakeS3.ListObjectsV2(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if token := aws.ToString(in.ContinuationToken); token != "" {
+		for start < len(all.Contents) && aws.ToString(all.Contents[start].Key) <= token {
+			start++
+		}
+	}
+	end := min(start+f.pageSize, len(all.Contents))
+	out := &s3.ListObjectsV2Output{Contents: all.Contents[start:end]}
+	if end < len(all.Contents) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = all.Contents[end-1].Key
+	}
+	return out, nil
+}
+
+func TestS3DownloadUserRepository(t *testing.T) {
+	ctx := context.Background()
+	client := &pagingS3{fakeS3: newFakeS3(), pageSize: 2}
+	upload := newS3Repo(t, client)
+	for _, u := range seedUsers(t) {
+		if err := upload.Upload(ctx, u); err != nil {
+			t.Fatalf("Upload(%d): %v", u.ID(), err)
+		}
+	}
+	client.objects["users/manifest.json"] = fakeS3Object{body: []byte("{}")}
+	repo := NewS3DownloadUserRepository(client, "bucket", "users")
+
+	ids, err := repo.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" || client.lists != 2 {
+		t.Errorf("List = %v over %d pages, want [1 2 3] over 2", ids, client.lists)
+	}
+	dto, err := repo.Get(ctx, 2)
+	if err != nil {
+		t.Fatalf("Get(2): %v", err)
+	}
+	if *dto != *userToDTO(mustNewUser(t, 2, "Bob", "bob@example.com", StatusInactive)) {
+		t.Errorf("Get(2) = %+v, want Bob", dto)
+	}
+	if _, err := repo.Get(ctx, 9); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get(9) error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestDomainRoutingUploadUserRepository(t *testing.T) {
+	ctx := context.Background()
+	partner := NewInMemoryUploadUserRepository()
+	fallback := NewInMemoryUploadUserRepository()
+	repo := NewDomainRoutingUploadUserRepository(map[string]UploadUserRepository{" Partner.com ": partner}, fallback)
+
+	for _, u := range []*User{
+		mustNewUser(t, 1, "Pat", "Pat@PARTNER.com", StatusActive),
+		mustNewUser(t, 2, "Alice", "alice@example.com", StatusActive),
+		mustNewUser(t, 3, "Sub", "sub@mail.partner.com", StatusActive),
+	} {
+		if err := repo.Upload(ctx, u); err != nil {
+			t.Fatalf("Upload(%d): %v", u.ID(), err)
+		}
+	}
+	ids := func(r *InMemoryUploadUserRepository) []int {
+		var out []int
+		for _, u := range r.Uploaded() {
+			out = append(out, u.ID())
+		}
+		return out
+	}
+	if got := ids(partner); fmt.Sprint(got) != "[1]" {
+		t.Errorf("partner repo got users %v, want [1]", got)
+	}
+	if got := ids(fallback); fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("fallback repo got users %v, want [2 3]", got)
+	}
+}
+
+func TestSequentialUploadUserUseCaseStopsAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var uploaded []int
+	repo := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		uploaded = append(uploaded, user.ID())
+		if user.ID() == 1 {
+			cancel()
+		}
+		return nil
+	}}
+
+	err := NewSequentialUploadUserUseCase(repo).Run(ctx, dtosFor(t, 4))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run error = %v, want context.Canceled", err)
+	}
+	if fmt.Sprint(uploaded) != "[1]" {
+		t.Errorf("uploaded users %v, want only [1]: users after the cancel must never be uploaded", uploaded)
+	}
+}
+
+func TestS3UploadWithMaxPayloadBytes(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, strings.Repeat("A", 200), "alice@example.com", StatusActive)
+
+	client := newFakeS3()
+	err := newS3Repo(t, client, WithMaxPayloadBytes(64)).Upload(ctx, user)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit of 64 bytes") {
+		t.Errorf("Upload error = %v, want the payload limit error", err)
+	}
+	if n := client.putCount(); n != 0 {
+		t.Errorf("%d PutObject calls for an oversized payload, want 0", n)
+	}
+
+	if err := newS3Repo(t, client).Upload(ctx, user); err != nil {
+		t.Errorf("Upload without a limit: %v", err)
+	}
+}
+
+func TestNewUserNormalizesName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "Foo Bar", want: "Foo Bar"},
+		{name: "  Foo   Bar  ", want: "Foo Bar"},
+		{name: "\tFoo\n\nBar\r", want: "Foo Bar"},
+		{name: "Foo\x00\x07Bar", want: "Foo Bar"},
+		{name: "Zoë  Ångström", want: "Zoë Ångström"},
+		{name: "   ", wantErr: true},
+		{name: "\x00\t\x1f", wantErr: true},
+		{name: "", wantErr: true},
+	} {
+		u, err := NewUser(1, tt.name, "foo@example.com", StatusActive)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewUser(name %q) error = %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && u.Name() != tt.want {
+			t.Errorf("NewUser(name %q).Name() = %q, want %q", tt.name, u.Name(), tt.want)
+		}
+	}
+}
+
+// statusV2Mapper stands in for a v2 DTO that numbers statuses from 10.
+type statusV2Mapper struct{}
+
+func (statusV2Mapper) ToEntity(dto *UserDTO) (*User, error) {
+	return NewUser(dto.ID, dto.Name, dto.Email, Status(dto.StatusCode-10))
+}
+
+func (statusV2Mapper) FromEntity(u *User) *UserDTO {
+	dto := userToDTO(u)
+	dto.StatusCode += 10
+	return dto
+}
+
+func TestUseCasesWithSwappedMapper(t *testing.T) {
+	ctx := context.Background()
+	dtos, err := NewFindAllUserUseCase(NewInMemoryFindUserRepository(seedUsers(t)...), WithMapper(statusV2Mapper{})).Run(ctx)
+	if err != nil {
+		t.Fatalf("FindAll Run: %v", err)
+	}
+	if dtos[0].StatusCode != 11 || dtos[1].StatusCode != 12 {
+		t.Errorf("status codes = %d, %d, want the v2 codes 11 and 12", dtos[0].StatusCode, dtos[1].StatusCode)
+	}
+
+	repo := NewInMemoryUploadUserRepository()
+	if err := NewUploadUserUseCase(repo, WithMapper(statusV2Mapper{})).Run(ctx, dtos[1]); err != nil {
+		t.Fatalf("Upload Run: %v", err)
+	}
+	if got := repo.Uploaded(); len(got) != 1 || got[0].StatusCode() != StatusInactive {
+		t.Errorf("uploaded %v, want Bob mapped back to status %d", got, StatusInactive)
+	}
+	if err := NewUploadUserUseCase(repo).Run(ctx, dtos[1]); err == nil {
+		t.Error("UserMapperV1 accepted the v2 status code 12, want an error")
+	}
+}
+
+func TestManifestUploadUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	readManifest := func(client *fakeS3) S3Manifest {
+		t.Helper()
+		var m S3Manifest
+		if err := json.Unmarshal(client.body(t, "users/manifest.json"), &m); err != nil {
+			t.Fatalf("decode manifest: %v", err)
+		}
+		return m
+	}
+
+	client := newFakeS3()
+	if err := NewManifestUploadUserUseCase(newS3Repo(t, client, WithClock(newTestClock(now)))).Run(ctx, dtosFor(t, 3)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	m := readManifest(client)
+	if want := []string{"users/user-1.json", "users/user-2.json", "users/user-3.json"}; fmt.Sprint(m.Keys) != fmt.Sprint(want) {
+		t.Errorf("manifest keys = %v, want %v", m.Keys, want)
+	}
+	if !m.GeneratedAt.Equal(now) {
+		t.Errorf("manifest generated_at = %v, want %v", m.GeneratedAt, now)
+	}
+
+	withBad := dtosFor(t, 3)
+	withBad[1].Email = "not-an-email"
+	failing := newFakeS3()
+	if err := NewManifestUploadUserUseCase(newS3Repo(t, failing)).Run(ctx, withBad); err == nil {
+		t.Fatal("Run succeeded with an invalid user")
+	}
+	if _, ok := failing.objects["users/manifest.json"]; ok {
+		t.Error("manifest written although a user failed")
+	}
+
+	partial := newFakeS3()
+	if err := NewManifestUploadUserUseCase(newS3Repo(t, partial), WithPartialManifest()).Run(ctx, withBad); err == nil {
+		t.Fatal("Run succeeded with an invalid user")
+	}
+	if keys := readManifest(partial).Keys; fmt.Sprint(keys) != "[users/user-1.json users/user-3.json]" {
+		t.Errorf("partial manifest keys = %v, want users 1 and 3", keys)
+	}
+}
+
+func BenchmarkNewUser100k(b *testing.B) {
+	const n = 100_000
+	dtos := make([]UserDTO, n)
+	for i := range dtos {
+		dtos[i] = UserDTO{ID: i + 1, Name: fmt.Sprintf("User %d", i+1), Email: fmt.Sprintf("user%d@example.com", i+1), StatusCode: int(StatusActive)}
+	}
+	// Keeping every user stops the compiler from dropping the construction.
+	users := make([]*User, n)
+
+	b.Run("Validated", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for i := range dtos {
+				u, err := NewUser(dtos[i].ID, dtos[i].Name, dtos[i].Email, Status(dtos[i].StatusCode))
+				if err != nil {
+					b.Fatal(err)
+				}
+				users[i] = u
+			}
+		}
+	})
+	b.Run("Unchecked", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for i := range dtos {
+				users[i] = NewUserUnchecked(dtos[i].ID, dtos[i].Name, dtos[i].Email, Status(dtos[i].StatusCode))
+			}
+		}
+	})
+}
+
+func TestCSVFindUserRepository(t *testing.T) {
+	repo, err := NewCSVFindUserRepository(strings.NewReader("id,name,email,status_code\n1,Alice,alice@example.com,1\n2,Bob,bob@example.com,2\n"))
+	if err != nil {
+		t.Fatalf("NewCSVFindUserRepository: %v", err)
+	}
+	users, err := repo.FindAll(context.Background())
+	if err != nil || len(users) != 2 || users[1].Name() != "Bob" {
+		t.Errorf("FindAll = %v, %v, want Alice and Bob", users, err)
+	}
+
+	for input, want := range map[string]string{
+		"id,name,email,status_code\n1,Alice,alice@example.com,1\n2,Bob,not-an-email,1\n":      "csv line 3: ",
+		"id,name,email,status_code\n1,Alice,alice@example.com,1\n\nx,Bob,bob@example.com,1\n": `csv line 4: id "x" is not a number`,
+	} {
+		if _, err := NewCSVFindUserRepository(strings.NewReader(input)); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("NewCSVFindUserRepository(%q) error = %v, want it to start with %q", input, err, want)
+		}
+	}
+}
+
+func TestS3UploadWithEmailRedaction(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 1, "John", "john.doe@example.com", StatusActive)
+	decode := func(client *fakeS3) S3User {
+		t.Helper()
+		var got S3User
+		if err := json.Unmarshal(client.body(t, "users/user-1.json"), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	redacted := newFakeS3()
+	if err := newS3Repo(t, redacted, WithEmailRedaction()).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := decode(redacted).Email; got != "j***@example.com" {
+		t.Errorf("redacted email = %q, want j***@example.com", got)
+	}
+	if user.Email() != "john.doe@example.com" {
+		t.Errorf("user email changed to %q by redaction", user.Email())
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := decode(plain).Email; got != "john.doe@example.com" {
+		t.Errorf("email without redaction = %q, want it unchanged", got)
+	}
+}
+
+func TestReconcileUseCaseReportsMismatch(t *testing.T) {
+	ctx := context.Background()
+	users := seedUsers(t)
+	client := newFakeS3()
+	store := newS3Repo(t, client)
+	for _, u := range users[:2] {
+		if err := store.Upload(ctx, u); err != nil {
+			t.Fatalf("Upload(%d): %v", u.ID(), err)
+		}
+	}
+	logger, records := captureLogger(t)
+
+	res, err := NewReconcileUseCase(NewInMemoryFindUserRepository(users...), store, WithLogger(logger)).Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if *res != (ReconcileResult{DBCount: 3, StoreCount: 2, Diff: 1}) {
+		t.Errorf("Run = %+v, want 3 in the DB, 2 in the store and a diff of 1", *res)
+	}
+	var warned bool
+	for _, rec := range records() {
+		if rec["level"] == "WARN" && rec["msg"] == "reconcile users mismatch" && rec["diff"] == float64(1) {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("no mismatch warning in %v", records())
+	}
+}
+
+func TestS3ClientUsesConfiguredHTTPClient(t *testing.T) {
+	client, requests := newInterceptedS3Client(t, &Config{AWSRegion: "ap-northeast-1"})
+	repo, err := NewS3UploadUserRepository(client, "company", "app/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Upload(context.Background(), mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	got := requests()
+	if len(got) != 1 || got[0].Method != http.MethodPut || got[0].URL.Path != "/app/user/user-1.json" {
+		t.Fatalf("intercepted requests = %v, want one PUT of app/user/user-1.json", got)
+	}
+	if host := got[0].URL.Host; host != "company.s3.ap-northeast-1.amazonaws.com" {
+		t.Errorf("request host = %q, want the regional bucket endpoint", host)
+	}
+}
+
+func TestS3UploadMapsErrorCodes(t *testing.T) {
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	for code, want := range map[string]error{
+		"AccessDenied": ErrS3AccessDenied,
+		"SlowDown":     ErrS3Throttled,
+		"NoSuchBucket": ErrS3NotFound,
+	} {
+		apiErr := &smithy.GenericAPIError{Code: code, Message: "from the fake"}
+		client := newFakeS3()
+		client.err = apiErr
+		err := newS3Repo(t, client).Upload(context.Background(), user)
+		if !errors.Is(err, want) {
+			t.Errorf("%s: Upload error = %v, want %v", code, err, want)
+		}
+		var got smithy.APIError
+		if !errors.As(err, &got) || got.ErrorCode() != code {
+			t.Errorf("%s: Upload error = %v, want the original API error kept", code, err)
+		}
+	}
+
+	client := newFakeS3()
+	client.err = &smithy.GenericAPIError{Code: "InternalError"}
+	err := newS3Repo(t, client).Upload(context.Background(), user)
+	for _, typed := range []error{ErrS3AccessDenied, ErrS3Throttled, ErrS3NotFound} {
+		if errors.Is(err, typed) {
+			t.Errorf("InternalError mapped to %v, want it left untyped", typed)
+		}
+	}
+}
+
+func TestPipelineUploadUserUseCaseDoesNotLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	ctx := context.Background()
+	users := make([]*User, 0, 5)
+	for _, dto := range dtosFor(t, 5) {
+		users = append(users, mustNewUser(t, dto.ID, dto.Name, dto.Email, Status(dto.StatusCode)))
+	}
+	stream := NewInMemoryFindUserRepository(users...).(StreamUserRepository)
+
+	recorded := NewInMemoryUploadUserRepository()
+	if err := NewPipelineUploadUserUseCase(stream, recorded, 3).Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var ids []int
+	for _, u := range recorded.Uploaded() {
+		ids = append(ids, u.ID())
+	}
+	sort.Ints(ids)
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+		t.Errorf("uploaded users %v, want all 5", ids)
+	}
+
+	errBoom := errors.New("boom")
+	failing := &MockUploadUserRepository{UploadFunc: func(ctx context.Context, user *User) error {
+		if user.ID() == 2 {
+			return errBoom
+		}
+		return nil
+	}}
+	if err := NewPipelineUploadUserUseCase(stream, failing, 2).Run(ctx); !errors.Is(err, errBoom) {
+		t.Errorf("Run error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestS3UploadWithObjectTags(t *testing.T) {
+	ctx := context.Background()
+	user := mustNewUser(t, 2, "Bob", "bob@example.com", StatusInactive)
+
+	client := newFakeS3()
+	if err := newS3Repo(t, client, WithObjectTags(map[string]string{"team": "data & ml", "status": "9"})).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got, want := aws.ToString(client.lastPut(t).Tagging), "status=2&team=data+%26+ml"; got != want {
+		t.Errorf("Tagging = %q, want %q", got, want)
+	}
+
+	plain := newFakeS3()
+	if err := newS3Repo(t, plain).Upload(ctx, user); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if tagging := plain.lastPut(t).Tagging; tagging != nil {
+		t.Errorf("Tagging = %q without the option, want unset", *tagging)
+	}
+}
+
+func TestFindModifiedSinceIsInclusive(t *testing.T) {
+	ctx := context.Background()
+	since := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	updatedAt := map[int]time.Time{
+		1: since.Add(-time.Nanosecond),
+		2: since,
+		3: since.Add(time.Hour),
+	}
+	repo := NewInMemoryModifiedSinceUserRepository(updatedAt, seedUsers(t)...).(ModifiedSinceUserRepository)
+
+	users, err := repo.FindModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatalf("FindModifiedSince: %v", err)
+	}
+	var ids []int
+	for _, u := range users {
+		ids = append(ids, u.ID())
+	}
+	if fmt.Sprint(ids) != "[2 3]" {
+		t.Errorf("FindModifiedSince = users %v, want [2 3]: the boundary is inclusive", ids)
+	}
+	if users, _ := repo.FindModifiedSince(ctx, since.Add(2*time.Hour)); len(users) != 0 {
+		t.Errorf("FindModifiedSince after every change = %v, want none", users)
+	}
+	if users, _ := NewInMemoryFindUserRepository(seedUsers(t)...).(ModifiedSinceUserRepository).FindModifiedSince(ctx, time.Time{}); len(users) != 0 {
+		t.Errorf("FindModifiedSince without times = %v, want none", users)
+	}
+}
+
+func TestChunkedUploadUserUseCaseFetchesInPages(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryFindUserRepository(usersFor(t, 5)...)
+	var fetches [][2]int
+	find := &MockFindUserRepository{FindPageFunc: func(ctx context.Context, limit int, offset int) ([]*User, error) {
+		fetches = append(fetches, [2]int{limit, offset})
+		return store.FindPage(ctx, limit, offset)
+	}}
+	upload := NewInMemoryUploadUserRepository()
+	var checkpoints []int
+
+	if err := NewChunkedUploadUserUseCase(find, upload, 2, WithCheckpoint(func(offset int) { checkpoints = append(checkpoints, offset) })).Run(ctx, 0); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := [][2]int{{2, 0}, {2, 2}, {2, 4}}; fmt.Sprint(fetches) != fmt.Sprint(want) {
+		t.Errorf("FindPage calls (limit, offset) = %v, want %v", fetches, want)
+	}
+	if fmt.Sprint(checkpoints) != "[2 4 5]" {
+		t.Errorf("checkpoints = %v, want [2 4 5]", checkpoints)
+	}
+	if n := len(upload.Uploaded()); n != 5 {
+		t.Errorf("uploaded %d users, want 5", n)
+	}
+
+	resumed := NewInMemoryUploadUserRepository()
+	if err := NewChunkedUploadUserUseCase(find, resumed, 2).Run(ctx, 4); err != nil {
+		t.Fatalf("Run from offset 4: %v", err)
+	}
+	if got := resumed.Uploaded(); len(got) != 1 || got[0].ID() != 5 {
+		t.Errorf("resumed run uploaded %v, want only user 5", got)
+	}
+}
+
+func TestS3ClientSendsAppID(t *testing.T) {
+	ctx := context.Background()
+	userAgent := func(cfg *Config) string {
+		t.Helper()
+		client, requests := newInterceptedS3Client(t, cfg)
+		if _, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("company"), Key: aws.String("k"), Body: strings.NewReader("{}")}); err != nil {
+			t.Fatalf("PutObject: %v", err)
+		}
+		got := requests()
+		if len(got) != 1 {
+			t.Fatalf("intercepted %d requests, want 1", len(got))
+		}
+		return got[0].Header.Get("User-Agent")
+	}
+
+	if ua := userAgent(&Config{AWSRegion: "us-east-1", AppID: "nightly-export"}); !strings.Contains(ua, "app/nightly-export") {
+		t.Errorf("User-Agent = %q, want it to carry app/nightly-export", ua)
+	}
+
+	setConfigEnv(t, map[string]string{"DATABASE_URL": "postgres://localhost/app", "S3_BUCKET": "company", "AWS_REGION": "us-east-1"})
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if ua := userAgent(cfg); !strings.Contains(ua, "app/"+defaultAppID) {
+		t.Errorf("User-Agent = %q, want it to carry the default app/%s", ua, defaultAppID)
+	}
+}
+
+// uniqueViolationDB fails every statement with a unique violation of
+// constraint, the way Postgres reports it.
+type uniqueViolationDB struct {
+	*sqlx.DB
+	constraint string
+}
+
+func (db uniqueViolationDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return nil, &pq.Error{Code: "23505", Constraint: db.constraint}
+}
+
+func TestPostgresCreateUserRepositoryMapsUniqueViolations(t *testing.T) {
+	user := mustNewUser(t, 1, "Alice", "alice@example.com", StatusActive)
+	for constraint, want := range map[string]error{
+		"user_email_key": ErrDuplicateEmail,
+		"user_pkey":      ErrDuplicateUserID,
+	} {
+		repo := &PostgresCreateUserRepository{db: uniqueViolationDB{newSQLiteUserDB(t), constraint}, table: "app.user"}
+		if err := repo.Create(context.Background(), user); !errors.Is(err, want) {
+			t.Errorf("%s: Create error = %v, want %v", constraint, err, want)
+		}
+	}
+
+	repo := &PostgresCreateUserRepository{db: uniqueViolationDB{newSQLiteUserDB(t), "user_name_key"}, table: "app.user"}
+	err := repo.Create(context.Background(), user)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || errors.Is(err, ErrDuplicateEmail) || errors.Is(err, ErrDuplicateUserID) {
+		t.Errorf("Create error = %v, want the other unique violation unchanged", err)
+	}
+}
+
+func TestUpdateUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	find := NewInMemoryFindUserRepository(seedUsers(t)...)
+	var updated []*User
+	update := &MockUpdateUserRepository{UpdateFunc: func(ctx context.Context, user *User) error {
+		updated = append(updated, user)
+		return nil
+	}}
+	uc := NewUpdateUserUseCase(find, update)
+
+	if _, err := uc.Run(ctx, &UserDTO{ID: 1, Email: "not-an-email"}); err == nil {
+		t.Error("Run with an invalid email succeeded")
+	}
+	if len(updated) != 0 {
+		t.Fatalf("Update called %d times for an invalid email, want 0", len(updated))
+	}
+
+	dto, err := uc.Run(ctx, &UserDTO{ID: 2, Name: "Robert"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := *userToDTO(mustNewUser(t, 2, "Robert", "bob@example.com", StatusInactive))
+	if *dto != want {
+		t.Errorf("Run = %+v, want %+v: zero fields keep the stored values", *dto, want)
+	}
+	if len(updated) != 1 || *userToDTO(updated[0]) != want {
+		t.Errorf("Update calls = %v, want one with %+v", updated, want)
+	}
+
+	if _, err := uc.Run(ctx, &UserDTO{ID: 9, Name: "Nobody"}); !errors.Is(err, ErrUserNotFound) || len(updated) != 1 {
+		t.Errorf("Run(9) = %v with %d updates, want ErrUserNotFound and no new update", err, len(updated))
+	}
+}
+
+func TestFindPageUserUseCase(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInMemoryFindUserRepository(usersFor(t, 5)...)
+	uc := NewFindPageUserUseCase(repo)
+
+	page, total, err := uc.Run(ctx, 2, 2)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(page) != 2 || page[0].ID != 3 || page[1].ID != 4 || total != 5 {
+		t.Errorf("Run(2, 2) = %+v with total %d, want users 3 and 4 of 5", page, total)
+	}
+	if page, total, err := uc.Run(ctx, 2, 10); err != nil || len(page) != 0 || total != 5 {
+		t.Errorf("Run(2, 10) = %+v, %d, %v, want an empty page of 5", page, total, err)
+	}
+
+	for _, tt := range []struct{ limit, offset int }{{-1, 0}, {2, -1}} {
+		if _, _, err := uc.Run(ctx, tt.limit, tt.offset); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+			t.Errorf("Run(%d, %d) error = %v, want a must not be negative error", tt.limit, tt.offset, err)
+		}
+		if _, err := repo.FindPage(ctx, tt.limit, tt.offset); err == nil {
+			t.Errorf("in-memory FindPage(%d, %d) succeeded, want the same validation error", tt.limit, tt.offset)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"id":1,"name":"Alice","email":"alice@example.com","status_code":1}]`)
+	}))
+	defer srv.Close()
+	if _, err := NewHTTPFindUserRepository(srv.Client(), srv.URL).FindPage(ctx, -1, 0); err == nil {
+		t.Error("HTTP FindPage(-1, 0) succeeded, want the validation error")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// errMockNotSet is returned by a mock method whose func field is nil.
+func errMockNotSet(method string) error {
+	return fmt.Errorf("mock: %sFunc is not set", method)
+}
+
+// MockFindUserRepository delegates every method to the matching func field,
+// so a test controls each result. Calling a method whose field is nil fails.
+type MockFindUserRepository struct {
+	FindAllFunc       func(ctx context.Context) ([]*User, error)
+	FindAllSortedFunc func(ctx context.Context, order UserOrder) ([]*User, error)
+	FindPageFunc      func(ctx context.Context, limit int, offset int) ([]*User, error)
+	FindAfterFunc     func(ctx context.Context, afterID int, limit int) ([]*User, error)
+	FindByIDFunc      func(ctx context.Context, id int) (*User, error)
+	FindByEmailFunc   func(ctx context.Context, email string) (*User, error)
+	FindByStatusFunc  func(ctx context.Context, status Status) ([]*User, error)
+	CountFunc         func(ctx context.Context) (int, error)
+}
+
+func (m *MockFindUserRepository) FindAll(ctx context.Context) ([]*User, error) {
+	if m.FindAllFunc == nil {
+		return nil, errMockNotSet("FindAll")
+	}
+	return m.FindAllFunc(ctx)
+}
+
+func (m *MockFindUserRepository) FindAllSorted(ctx context.Context, order UserOrder) ([]*User, error) {
+	if m.FindAllSortedFunc == nil {
+		return nil, errMockNotSet("FindAllSorted")
+	}
+	return m.FindAllSortedFunc(ctx, order)
+}
+
+func (m *MockFindUserRepository) FindPage(ctx context.Context, limit int, offset int) ([]*User, error) {
+	if m.FindPageFunc == nil {
+		return nil, errMockNotSet("FindPage")
+	}
+	return m.FindPageFunc(ctx, limit, offset)
+}
+
+func (m *MockFindUserRepository) FindAfter(ctx context.Context, afterID int, limit int) ([]*User, error) {
+	if m.FindAfterFunc == nil {
+		return nil, errMockNotSet("FindAfter")
+	}
+	return m.FindAfterFunc(ctx, afterID, limit)
+}
+
+func (m *MockFindUserRepository) FindByID(ctx context.Context, id int) (*User, error) {
+	if m.FindByIDFunc == nil {
+		return nil, errMockNotSet("FindByID")
+	}
+	return m.FindByIDFunc(ctx, id)
+}
+
+func (m *MockFindUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	if m.FindByEmailFunc == nil {
+		return nil, errMockNotSet("FindByEmail")
+	}
+	return m.FindByEmailFunc(ctx, email)
+}
+
+func (m *MockFindUserRepository) FindByStatus(ctx context.Context, status Status) ([]*User, error) {
+	if m.FindByStatusFunc == nil {
+		return nil, errMockNotSet("FindByStatus")
+	}
+	return m.FindByStatusFunc(ctx, status)
+}
+
+func (m *MockFindUserRepository) Count(ctx context.Context) (int, error) {
+	if m.CountFunc == nil {
+		return 0, errMockNotSet("Count")
+	}
+	return m.CountFunc(ctx)
+}
+
+// MockUploadUserRepository delegates Upload to UploadFunc.
+type MockUploadUserRepository struct {
+	UploadFunc func(ctx context.Context, user *User) error
+}
+
+func (m *MockUploadUserRepository) Upload(ctx context.Context, user *User) error {
+	if m.UploadFunc == nil {
+		return errMockNotSet("Upload")
+	}
+	return m.UploadFunc(ctx, user)
+}
+
+// MockUpdateUserRepository delegates Update to UpdateFunc.
+type MockUpdateUserRepository struct {
+	UpdateFunc func(ctx context.Context, user *User) error
+}
+
+func (m *MockUpdateUserRepository) Update(ctx context.Context, user *User) error {
+	if m.UpdateFunc == nil {
+		return errMockNotSet("Update")
+	}
+	return m.UpdateFunc(ctx, user)
+}
@@ -0,0 +1,149 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+// newPostgresUserDB starts a disposable Postgres container, creates the
+// app.user table and returns a connection to it. The container is removed
+// when the test ends. Run these tests with: go test -tags integration ./...
+func newPostgresUserDB(t testing.TB) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+	ctr, err := tcpostgres.Run(ctx, "postgres:16-alpine",
+		tcpostgres.WithDatabase("app"),
+		tcpostgres.WithUsername("app"),
+		tcpostgres.WithPassword("app"),
+		tcpostgres.BasicWaitStrategies(),
+	)
+	testcontainers.CleanupContainer(t, ctr)
+	if err != nil {
+		t.Fatalf("start postgres: %v", err)
+	}
+	dsn, err := ctr.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("connection string: %v", err)
+	}
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect to postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, stmt := range []string{
+		`CREATE SCHEMA app`,
+		`CREATE TABLE app.user (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			email TEXT NOT NULL UNIQUE,
+			status_code INTEGER NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func TestPostgresFindUserRepositoryIntegration(t *testing.T) {
+	ctx := context.Background()
+	db := newPostgresUserDB(t)
+	if _, err := db.Exec(`INSERT INTO app.user (id, name, email, status_code, updated_at) VALUES
+		(1, 'Alice', 'alice@example.com', 1, '2026-01-01T00:00:00Z'),
+		(2, 'Bob', 'bob@example.com', 2, '2026-02-01T00:00:00Z')`); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresFindUserRepository(db)
+
+	users, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("FindAll returned %d users, want 2", len(users))
+	}
+	if _, err := repo.FindByID(ctx, 3); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindByID(3) error = %v, want ErrUserNotFound", err)
+	}
+	modified, err := repo.(ModifiedSinceUserRepository).FindModifiedSince(ctx, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("FindModifiedSince: %v", err)
+	}
+	if len(modified) != 1 || modified[0].ID() != 2 {
+		t.Errorf("FindModifiedSince = %v, want only Bob", modified)
+	}
+}
+
+func TestPostgresCreateUserRepositoryIntegration(t *testing.T) {
+	ctx := context.Background()
+	db := newPostgresUserDB(t)
+	uc := NewCreateUserUseCase(NewPostgresCreateUserRepository(db))
+
+	created, err := uc.Run(ctx, mustNewUnsavedUserDTO(t, "Alice"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if created.ID == 0 {
+		t.Error("created user has no id, want the one assigned by the database")
+	}
+	other, err := NewUnsavedUserDTO("Other", "alice@example.com", int(StatusActive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uc.Run(ctx, other); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Run with a taken email error = %v, want ErrDuplicateEmail", err)
+	}
+	_, err = uc.Run(ctx, userToDTO(mustNewUser(t, created.ID, "Bob", "bob@example.com", StatusActive)))
+	if !errors.Is(err, ErrDuplicateUserID) || errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Run with a taken id error = %v, want ErrDuplicateUserID only", err)
+	}
+}
+
+func TestPostgresUpsertUserRepositoryIntegration(t *testing.T) {
+	ctx := context.Background()
+	db := newPostgresUserDB(t)
+	uc := NewUpsertUserUseCase(NewPostgresUpsertUserRepository(db))
+
+	first, inserted, err := uc.Run(ctx, mustNewUnsavedUserDTO(t, "Alice"))
+	if err != nil || !inserted {
+		t.Fatalf("first Run = inserted %t, %v, want an insert", inserted, err)
+	}
+	renamed, err := NewUnsavedUserDTO("Alice Smith", "alice@example.com", int(StatusInactive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, inserted, err := uc.Run(ctx, renamed)
+	if err != nil || inserted {
+		t.Fatalf("second Run = inserted %t, %v, want an update", inserted, err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("updated user id = %d, want %d", second.ID, first.ID)
+	}
+	var name string
+	if err := db.Get(&name, `SELECT name FROM app.user WHERE id = $1`, first.ID); err != nil || name != "Alice Smith" {
+		t.Errorf("stored name = %q, %v, want Alice Smith", name, err)
+	}
+}
+
+func TestPostgresBulkCreateUserRepositoryIntegration(t *testing.T) {
+	ctx := context.Background()
+	db := newPostgresUserDB(t)
+
+	if err := NewPostgresBulkCreateUserRepository(db).BulkCreate(ctx, seedUsers(t)); err != nil {
+		t.Fatalf("BulkCreate: %v", err)
+	}
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM app.user`); err != nil || n != 3 {
+		t.Errorf("%d rows after COPY, %v, want 3", n, err)
+	}
+}